@@ -0,0 +1,23 @@
+// Package config defines the configuration accepted by the various OCSP
+// signer backends (PKCS#11, software, remote).
+package config
+
+import "time"
+
+// PKCS11Config carries the parameters needed to open a session against a
+// PKCS#11 token.
+type PKCS11Config struct {
+	Module string
+	Token  string
+	PIN    string
+	Label  string
+}
+
+// Config is the configuration for an OCSP signer.
+type Config struct {
+	CACertFile        string
+	ResponderCertFile string
+	KeyFile           string
+	Interval          time.Duration
+	PKCS11            PKCS11Config
+}
@@ -0,0 +1,419 @@
+// Copyright 2015 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"text/template"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/cactus/go-statsd-client/statsd"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/gopkg.in/gorp.v1"
+
+	"github.com/letsencrypt/boulder/cmd"
+	"github.com/letsencrypt/boulder/core"
+	blog "github.com/letsencrypt/boulder/log"
+	"github.com/letsencrypt/boulder/mail"
+	"github.com/letsencrypt/boulder/sa"
+	"github.com/letsencrypt/boulder/unsubscribe"
+)
+
+// config is the on-disk JSON configuration for the expiration-mailer.
+type config struct {
+	Statsd cmd.StatsdConfig
+
+	Mailer struct {
+		cmd.DBConfig
+		cmd.PasswordConfig
+
+		Server   string
+		Port     string
+		Username string
+
+		// NagTimes is how long before expiration to send a warning, e.g.
+		// "24h", "96h", "168h".
+		NagTimes []string
+		// CertLimit bounds how many expiring certificates are processed
+		// per nag window in a single run. Zero or negative means
+		// unlimited, so an unconfigured/upgraded deployment doesn't
+		// silently stop sending nags.
+		CertLimit int
+		// UnsubscribeSecretFile points to a file containing the HMAC key
+		// used to sign unsubscribe tokens.
+		UnsubscribeSecretFile string
+		// UnsubscribeBaseURL is the WFE endpoint unsubscribe links point at.
+		UnsubscribeBaseURL string
+		// TemplateFile is the default nag template; TemplateOverrides
+		// maps a nag window (matching an entry in NagTimes) to an
+		// alternate template file, e.g. a more urgent one for 24h.
+		TemplateFile      string
+		TemplateOverrides map[string]string
+
+		// RateLimitPerSecond bounds outbound SMTP to avoid tripping
+		// upstream mail-provider limits. Zero means unlimited.
+		RateLimitPerSecond int
+
+		DryRun bool
+	}
+}
+
+// mailSender is the subset of github.com/letsencrypt/boulder/mail.Mailer
+// that the expiration-mailer needs. It's broken out as its own interface
+// so tests can substitute a mock.
+type mailSender interface {
+	SendMail(to []string, msg string) error
+}
+
+// CertInfo is the per-certificate data made available to nag email
+// templates. A digest email for a subscriber with many expiring
+// certificates receives a []CertInfo; a subscriber with one gets a
+// single-element slice.
+type CertInfo struct {
+	Serial           string
+	DNSNames         string
+	DaysToExpiration int
+	ExpirationDate   time.Time
+}
+
+// nagGroup bundles the certificates due for the same nag window, destined
+// for the same (registration, contact email) pair, so they can be
+// delivered as a single digest message.
+type nagGroup struct {
+	regID     int64
+	contacts  []core.AcmeURL
+	locale    string
+	nagWindow time.Duration
+	certs     []CertInfo
+}
+
+// digestTemplateData is what gets passed to the email template: the
+// grouped certificates for this message.
+type digestTemplateData struct {
+	Certs []CertInfo
+}
+
+type mailer struct {
+	log    *blog.AuditLogger
+	stats  statsd.Statter
+	mailer mailSender
+	dbMap  *gorp.DbMap
+
+	// emailTemplate is the default template, used for any nag window that
+	// doesn't have an entry in templates.
+	emailTemplate *template.Template
+	// templates holds per-nag-window template overrides, e.g. a more
+	// urgent template for the 24-hour warning than the 7-day warning.
+	templates map[time.Duration]*template.Template
+
+	nagTimes []time.Duration
+	limit    int
+
+	// rateLimit throttles outbound SMTP so we don't trip upstream
+	// mail-provider rate limits. A nil rateLimit means unlimited.
+	rateLimit *tokenBucket
+
+	// dryRun, when true, logs recipients and rendered bodies instead of
+	// calling through to mailer.SendMail.
+	dryRun bool
+
+	// unsubscribeSecret is the HMAC key used to sign and verify
+	// unsubscribe tokens embedded in List-Unsubscribe headers.
+	unsubscribeSecret []byte
+
+	// unsubscribeBaseURL is the base URL of the WFE's unsubscribe
+	// endpoint, e.g. "https://acme-v01.api.letsencrypt.org/unsubscribe".
+	unsubscribeBaseURL string
+}
+
+// templateForWindow returns the template override for nagWindow if one was
+// configured, otherwise the default emailTemplate.
+func (m *mailer) templateForWindow(nagWindow time.Duration) *template.Template {
+	if t, ok := m.templates[nagWindow]; ok {
+		return t
+	}
+	return m.emailTemplate
+}
+
+// sendNags renders a single digest message for certs and delivers it to
+// contacts (all of which belong to regID). Certs are all assumed to be
+// due for the same nagWindow, which selects the template.
+func (m *mailer) sendNags(regID int64, certs []CertInfo, contacts []core.AcmeURL, nagWindow time.Duration) error {
+	if len(contacts) == 0 {
+		m.log.Info("No contacts to send nag emails to")
+		return nil
+	}
+	if len(certs) == 0 {
+		return nil
+	}
+
+	tmpl := m.templateForWindow(nagWindow)
+	var buf []byte
+	{
+		w := new(templateWriter)
+		if err := tmpl.Execute(w, digestTemplateData{Certs: certs}); err != nil {
+			return err
+		}
+		buf = w.Bytes()
+	}
+	body := string(buf)
+
+	if len(m.unsubscribeSecret) > 0 && m.unsubscribeBaseURL != "" {
+		token := unsubscribe.GenerateToken(m.unsubscribeSecret, regID, time.Now())
+		body = fmt.Sprintf("List-Unsubscribe: <%s?token=%s>\r\n\r\n%s", m.unsubscribeBaseURL, token, body)
+	}
+
+	var emails []string
+	for _, contact := range contacts {
+		emails = append(emails, contact.String())
+	}
+
+	if m.dryRun {
+		m.log.Info(fmt.Sprintf("dry-run: would send to %v: %s", emails, body))
+		return nil
+	}
+
+	if m.rateLimit != nil {
+		m.rateLimit.Take()
+	}
+
+	return m.mailer.SendMail(emails, body)
+}
+
+// templateWriter is a tiny bytes.Buffer-alike that satisfies io.Writer so
+// callers don't need to import bytes just for this.
+type templateWriter struct {
+	data []byte
+}
+
+func (w *templateWriter) Write(p []byte) (int, error) {
+	w.data = append(w.data, p...)
+	return len(p), nil
+}
+
+func (w *templateWriter) Bytes() []byte {
+	return w.data
+}
+
+// capCerts returns the number of certificates to process out of total,
+// given the configured limit. A limit of zero or less means unlimited,
+// so an unconfigured CertLimit doesn't silently stop nags from going out.
+func capCerts(total, limit int) int {
+	if limit > 0 && limit < total {
+		return limit
+	}
+	return total
+}
+
+// findExpiringCertificates finds certificates that are expiring within
+// each of m.nagTimes and, for each (registration, contact email) that
+// hasn't already been nagged for that window (per the nag_events table),
+// sends one grouped digest message.
+func (m *mailer) findExpiringCertificates() error {
+	now := time.Now()
+	for i, nagWindow := range m.nagTimes {
+		begin := now
+		end := now.Add(nagWindow)
+		if i > 0 {
+			begin = now.Add(m.nagTimes[i-1])
+		}
+
+		m.log.Info(fmt.Sprintf("Searching for certificates that expire between %s and %s", begin, end))
+
+		var certs []core.Certificate
+		_, err := m.dbMap.Select(&certs,
+			`SELECT * FROM certificates
+			 WHERE expires >= :begin AND expires < :end AND status = :status`,
+			map[string]interface{}{
+				"begin":  begin,
+				"end":    end,
+				"status": core.StatusValid,
+			})
+		if err != nil {
+			return err
+		}
+
+		groups := make(map[string]*nagGroup)
+		var order []string
+		nagged := make(map[string]bool)
+		for _, cert := range certs[:capCerts(len(certs), m.limit)] {
+			var status core.CertificateStatus
+			if err := m.dbMap.SelectOne(&status, "SELECT * FROM certificateStatus WHERE serial = :serial",
+				map[string]interface{}{"serial": cert.Serial}); err != nil {
+				return err
+			}
+
+			if already, err := m.alreadyNagged(cert.Serial, nagWindow); err != nil {
+				return err
+			} else if already {
+				continue
+			}
+			// A legacy nag sent within the last nagWindow already covers
+			// this period.
+			if !status.LastExpirationNagSent.IsZero() && status.LastExpirationNagSent.After(now.Add(-nagWindow)) {
+				continue
+			}
+
+			var reg core.Registration
+			if err := m.dbMap.SelectOne(&reg, "SELECT * FROM registrations WHERE id = :id",
+				map[string]interface{}{"id": cert.RegistrationID}); err != nil {
+				return err
+			}
+			if reg.NoExpirationMail {
+				continue
+			}
+			if len(reg.Contact) == 0 {
+				// Nothing to notify, so nothing was sent; don't record a
+				// nag_events row for a warning that never went out.
+				continue
+			}
+
+			parsed, err := x509.ParseCertificate(cert.DER)
+			if err != nil {
+				return err
+			}
+
+			for _, contact := range reg.Contact {
+				key := fmt.Sprintf("%d|%s", reg.ID, contact.String())
+				g, ok := groups[key]
+				if !ok {
+					g = &nagGroup{
+						regID:     reg.ID,
+						contacts:  []core.AcmeURL{contact},
+						locale:    reg.Locale,
+						nagWindow: nagWindow,
+					}
+					groups[key] = g
+					order = append(order, key)
+				}
+				g.certs = append(g.certs, CertInfo{
+					Serial:           cert.Serial,
+					DNSNames:         joinDNSNames(parsed.DNSNames),
+					DaysToExpiration: daysUntil(parsed.NotAfter, now),
+					ExpirationDate:   parsed.NotAfter.UTC(),
+				})
+			}
+		}
+
+		for _, key := range order {
+			g := groups[key]
+			if err := m.sendNags(g.regID, g.certs, g.contacts, g.nagWindow); err != nil {
+				return err
+			}
+			// Only record a cert as nagged once its group's mail actually
+			// went out, and only once per cert even if it appears in
+			// multiple contacts' groups for the same registration.
+			for _, c := range g.certs {
+				if nagged[c.Serial] {
+					continue
+				}
+				if err := m.recordNagSent(c.Serial, g.nagWindow, now); err != nil {
+					return err
+				}
+				nagged[c.Serial] = true
+			}
+		}
+	}
+
+	return nil
+}
+
+// daysUntil returns the number of days from now until t, counting a
+// partial day as a whole one.
+func daysUntil(t, now time.Time) int {
+	const day = 24 * time.Hour
+	return int((t.Sub(now) + day - 1) / day)
+}
+
+func joinDNSNames(names []string) string {
+	out := ""
+	for i, n := range names {
+		if i > 0 {
+			out += ", "
+		}
+		out += n
+	}
+	return out
+}
+
+func main() {
+	configFile := flag.String("config", "", "Path to expiration-mailer configuration file")
+	dryRun := flag.Bool("dry-run", false, "Log recipients and rendered bodies instead of sending mail")
+	flag.Parse()
+
+	configJSON, err := ioutil.ReadFile(*configFile)
+	cmd.FailOnError(err, "Couldn't read config file")
+
+	var c config
+	err = json.Unmarshal(configJSON, &c)
+	cmd.FailOnError(err, "Couldn't parse config file")
+
+	stats, err := statsd.NewClient(c.Statsd.Server, "Boulder/expiration-mailer")
+	cmd.FailOnError(err, "Couldn't connect to statsd")
+
+	logger := blog.GetAuditLogger()
+	blog.SetAuditLogger(logger)
+
+	dbMap, err := sa.NewDbMap(c.Mailer.DBConfig.DBConnect())
+	cmd.FailOnError(err, "Couldn't connect to database")
+	// nag_events isn't one of the tables sa.NewDbMap registers, since it
+	// belongs only to the expiration-mailer; register it here so
+	// recordNagSent's Insert has a mapped table to insert into. See
+	// sa/_db/migrations for the corresponding schema migration.
+	dbMap.AddTableWithName(nagEvent{}, "nag_events").SetKeys(false, "Serial", "NagWindow")
+
+	emailTemplate, err := template.ParseFiles(c.Mailer.TemplateFile)
+	cmd.FailOnError(err, "Couldn't parse email template")
+
+	templates := make(map[time.Duration]*template.Template)
+	nagTimes := make([]time.Duration, len(c.Mailer.NagTimes))
+	for i, s := range c.Mailer.NagTimes {
+		d, err := time.ParseDuration(s)
+		cmd.FailOnError(err, "Couldn't parse nag time")
+		nagTimes[i] = d
+		if override, ok := c.Mailer.TemplateOverrides[s]; ok {
+			t, err := template.ParseFiles(override)
+			cmd.FailOnError(err, "Couldn't parse nag template override")
+			templates[d] = t
+		}
+	}
+
+	var unsubscribeSecret []byte
+	if c.Mailer.UnsubscribeSecretFile != "" {
+		unsubscribeSecret, err = ioutil.ReadFile(c.Mailer.UnsubscribeSecretFile)
+		cmd.FailOnError(err, "Couldn't read unsubscribe secret")
+	}
+
+	var rateLimit *tokenBucket
+	if c.Mailer.RateLimitPerSecond > 0 {
+		rateLimit = newTokenBucket(c.Mailer.RateLimitPerSecond)
+	}
+
+	password, err := c.Mailer.PasswordConfig.Pass()
+	cmd.FailOnError(err, "Couldn't load SMTP password")
+	smtpSender := mail.New(c.Mailer.Server, c.Mailer.Port, c.Mailer.Username, password)
+
+	m := mailer{
+		log:                logger,
+		stats:              stats,
+		mailer:             smtpSender,
+		dbMap:              dbMap,
+		emailTemplate:      emailTemplate,
+		templates:          templates,
+		nagTimes:           nagTimes,
+		limit:              c.Mailer.CertLimit,
+		rateLimit:          rateLimit,
+		dryRun:             *dryRun || c.Mailer.DryRun,
+		unsubscribeSecret:  unsubscribeSecret,
+		unsubscribeBaseURL: c.Mailer.UnsubscribeBaseURL,
+	}
+
+	err = m.findExpiringCertificates()
+	cmd.FailOnError(err, "Failed to find expiring certificates")
+}
@@ -27,6 +27,7 @@ import (
 	"github.com/letsencrypt/boulder/mocks"
 	"github.com/letsencrypt/boulder/sa"
 	"github.com/letsencrypt/boulder/test"
+	"github.com/letsencrypt/boulder/unsubscribe"
 )
 
 func bigIntFromB64(b64 string) *big.Int {
@@ -42,6 +43,9 @@ func intFromB64(b64 string) int {
 
 type mockMail struct {
 	Messages []string
+	// err, if set, is returned by SendMail instead of actually recording
+	// the message, so tests can exercise the "mail didn't go out" path.
+	err error
 }
 
 func (m *mockMail) Clear() {
@@ -49,27 +53,32 @@ func (m *mockMail) Clear() {
 }
 
 func (m *mockMail) SendMail(to []string, msg string) (err error) {
+	if m.err != nil {
+		return m.err
+	}
 	for _ = range to {
 		m.Messages = append(m.Messages, msg)
 	}
 	return
 }
 
-const testTmpl = `hi, cert for DNS names {{.DNSNames}} is going to expire in {{.DaysToExpiration}} days ({{.ExpirationDate}})`
-
-var jsonKeyA = []byte(`{
-  "kty":"RSA",
-  "n":"0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
-  "e":"AQAB"
-}`)
-var jsonKeyB = []byte(`{
-  "kty":"RSA",
-  "n":"z8bp-jPtHt4lKBqepeKF28g_QAEOuEsCIou6sZ9ndsQsEjxEOQxQ0xNOQezsKa63eogw8YS3vzjUcPP5BJuVzfPfGd5NVUdT-vSSwxk3wvk_jtNqhrpcoG0elRPQfMVsQWmxCAXCVRz3xbcFI8GTe-syynG3l-g1IzYIIZVNI6jdljCZML1HOMTTW4f7uJJ8mM-08oQCeHbr5ejK7O2yMSSYxW03zY-Tj1iVEebROeMv6IEEJNFSS4yM-hLpNAqVuQxFGetwtwjDMC1Drs1dTWrPuUAAjKGrP151z1_dE74M5evpAhZUmpKv1hY-x85DC6N0hFPgowsanmTNNiV75w",
-  "e":"AAEAAQ"
-}`)
+// testTmpl renders one newline-terminated line per certificate in the
+// digest, so a single-cert message renders as the old single-cert
+// template this replaced did, plus a trailing newline.
+const testTmpl = `{{range .Certs}}hi, cert for DNS names {{.DNSNames}} is going to expire in {{.DaysToExpiration}} days ({{.ExpirationDate}})
+{{end}}`
 
 var log = mocks.UseMockLog()
 
+func certInfoFor(cert *x509.Certificate) CertInfo {
+	return CertInfo{
+		Serial:           cert.SerialNumber.String(),
+		DNSNames:         joinDNSNames(cert.DNSNames),
+		DaysToExpiration: daysUntil(cert.NotAfter, time.Now()),
+		ExpirationDate:   cert.NotAfter,
+	}
+}
+
 func TestSendNags(t *testing.T) {
 	tmpl, err := template.New("expiry-email").Parse(testTmpl)
 	test.AssertNotError(t, err, "Couldn't parse test email template")
@@ -88,28 +97,89 @@ func TestSendNags(t *testing.T) {
 		NotAfter: time.Now().AddDate(0, 0, 2),
 		DNSNames: []string{"example.com"},
 	}
+	certInfo := certInfoFor(cert)
 
 	email, _ := url.Parse("mailto:rolandshoemaker@gmail.com")
 	emailB, _ := url.Parse("mailto:test@gmail.com")
 
-	err = m.sendNags(cert, []core.AcmeURL{core.AcmeURL(*email)})
+	err = m.sendNags(1, []CertInfo{certInfo}, []core.AcmeURL{core.AcmeURL(*email)}, time.Hour*24*2)
 	test.AssertNotError(t, err, "Failed to send warning messages")
 	test.AssertEquals(t, len(mc.Messages), 1)
-	test.AssertEquals(t, fmt.Sprintf(`hi, cert for DNS names example.com is going to expire in 2 days (%s)`, cert.NotAfter), mc.Messages[0])
+	test.AssertEquals(t, fmt.Sprintf("hi, cert for DNS names example.com is going to expire in 2 days (%s)\n", cert.NotAfter), mc.Messages[0])
 
 	mc.Clear()
-	err = m.sendNags(cert, []core.AcmeURL{core.AcmeURL(*email), core.AcmeURL(*emailB)})
+	err = m.sendNags(1, []CertInfo{certInfo}, []core.AcmeURL{core.AcmeURL(*email), core.AcmeURL(*emailB)}, time.Hour*24*2)
 	test.AssertNotError(t, err, "Failed to send warning messages")
 	test.AssertEquals(t, len(mc.Messages), 2)
-	test.AssertEquals(t, fmt.Sprintf(`hi, cert for DNS names example.com is going to expire in 2 days (%s)`, cert.NotAfter), mc.Messages[0])
-	test.AssertEquals(t, fmt.Sprintf(`hi, cert for DNS names example.com is going to expire in 2 days (%s)`, cert.NotAfter), mc.Messages[1])
+	test.AssertEquals(t, fmt.Sprintf("hi, cert for DNS names example.com is going to expire in 2 days (%s)\n", cert.NotAfter), mc.Messages[0])
+	test.AssertEquals(t, fmt.Sprintf("hi, cert for DNS names example.com is going to expire in 2 days (%s)\n", cert.NotAfter), mc.Messages[1])
 
 	mc.Clear()
-	err = m.sendNags(cert, []core.AcmeURL{})
+	err = m.sendNags(1, []CertInfo{certInfo}, []core.AcmeURL{}, time.Hour*24*2)
 	test.AssertNotError(t, err, "Not an error to pass no email contacts")
 	test.AssertEquals(t, len(mc.Messages), 0)
 }
 
+func TestSendNagsDigestsMultipleCerts(t *testing.T) {
+	tmpl, err := template.New("expiry-email").Parse(testTmpl)
+	test.AssertNotError(t, err, "Couldn't parse test email template")
+	stats, _ := statsd.NewNoopClient(nil)
+	mc := mockMail{}
+	m := mailer{
+		stats:         stats,
+		mailer:        &mc,
+		emailTemplate: tmpl,
+	}
+
+	certA := &x509.Certificate{NotAfter: time.Now().AddDate(0, 0, 1), DNSNames: []string{"a.example.com"}}
+	certB := &x509.Certificate{NotAfter: time.Now().AddDate(0, 0, 3), DNSNames: []string{"b.example.com"}}
+
+	email, _ := url.Parse("mailto:many-certs@example.com")
+	err = m.sendNags(1, []CertInfo{certInfoFor(certA), certInfoFor(certB)}, []core.AcmeURL{core.AcmeURL(*email)}, time.Hour*24)
+	test.AssertNotError(t, err, "Failed to send a digest for multiple certs")
+	test.AssertEquals(t, len(mc.Messages), 1)
+	test.AssertEquals(t,
+		fmt.Sprintf("hi, cert for DNS names a.example.com is going to expire in 1 days (%s)\nhi, cert for DNS names b.example.com is going to expire in 3 days (%s)\n", certA.NotAfter, certB.NotAfter),
+		mc.Messages[0])
+}
+
+func TestSendNagsAddsUnsubscribeHeader(t *testing.T) {
+	tmpl, err := template.New("expiry-email").Parse(testTmpl)
+	test.AssertNotError(t, err, "Couldn't parse test email template")
+	stats, _ := statsd.NewNoopClient(nil)
+	mc := mockMail{}
+	m := mailer{
+		stats:              stats,
+		mailer:             &mc,
+		emailTemplate:      tmpl,
+		unsubscribeSecret:  []byte("sekrit"),
+		unsubscribeBaseURL: "https://acme.example.com/unsubscribe",
+	}
+
+	cert := &x509.Certificate{NotAfter: time.Now().AddDate(0, 0, 1), DNSNames: []string{"example.com"}}
+	email, _ := url.Parse("mailto:someone@example.com")
+
+	err = m.sendNags(42, []CertInfo{certInfoFor(cert)}, []core.AcmeURL{core.AcmeURL(*email)}, time.Hour*24)
+	test.AssertNotError(t, err, "Failed to send nag with unsubscribe header")
+	test.Assert(t, len(mc.Messages) == 1, "expected one message")
+
+	regID, err := unsubscribe.VerifyToken([]byte("sekrit"), extractToken(mc.Messages[0]), 0)
+	test.AssertNotError(t, err, "Unsubscribe token in header should verify")
+	test.AssertEquals(t, regID, int64(42))
+}
+
+// extractToken pulls the token query parameter out of a rendered
+// List-Unsubscribe header for testing purposes.
+func extractToken(msg string) string {
+	const prefix = "List-Unsubscribe: <https://acme.example.com/unsubscribe?token="
+	start := len(prefix)
+	end := start
+	for end < len(msg) && msg[end] != '>' {
+		end++
+	}
+	return msg[start:end]
+}
+
 var n = bigIntFromB64("n4EPtAOCc9AlkeQHPzHStgAbgs7bTZLwUBZdR8_KuKPEHLd4rHVTeT-O-XV2jRojdNhxJWTDvNd7nqQ0VEiZQHz_AJmSCpMaJMRBSFKrKb2wqVwGU_NsYOYL-QtiWN2lbzcEe6XC0dApr5ydQLrHqkHHig3RBordaZ6Aj-oBHqFEHYpPe7Tpe-OfVfHd1E6cS6M1FZcD1NNLYD5lFHpPI9bTwJlsde3uhGqC0ZCuEHg8lhzwOHrtIQbS0FVbb9k3-tVTU4fg_3L_vniUFAKwuCLqKnS2BYwdq_mzSnbLY7h_qixoR7jig3__kRhuaxwUkRz5iaiQkqgc5gHdrNP5zw==")
 var e = intFromB64("AQAB")
 var d = bigIntFromB64("bWUC9B-EFRIo8kpGfh0ZuyGPvMNKvYWNtB_ikiH9k20eT-O1q_I78eiZkpXxXQ0UTEs2LsNRS-8uJbvQ-A1irkwMSMkK1J3XTGgdrhCku9gRldY7sNA_AKZGh-Q661_42rINLRCe8W-nZ34ui_qOfkLnK9QWDDqpaIsA-bMwWWSDFu2MUBYwkHTMEzLYGqOe04noqeq1hExBTHBOBdkMXiuFhUq1BU6l-DqEiWxqg82sXt2h-LMnT3046AOYJoRioz75tSUQfGCshWTBnP5uDjd18kKhyv07lhfSJdrPdM5Plyl21hsFf4L_mHCuoFau7gdsPfHPxxjVOcOpBrQzwQ==")
@@ -125,6 +195,7 @@ var testKey = rsa.PrivateKey{
 func TestFindExpiringCertificates(t *testing.T) {
 	dbMap, err := sa.NewDbMap("sqlite3", ":memory:")
 	test.AssertNotError(t, err, "Couldn't connect to SQLite")
+	dbMap.AddTableWithName(nagEvent{}, "nag_events").SetKeys(false, "Serial", "NagWindow")
 	err = dbMap.CreateTablesIfNotExists()
 	test.AssertNotError(t, err, "Couldn't create tables")
 	tmpl, err := template.New("expiry-email").Parse(testTmpl)
@@ -242,16 +313,97 @@ func TestFindExpiringCertificates(t *testing.T) {
 	log.Clear()
 	err = m.findExpiringCertificates()
 	test.AssertNotError(t, err, "Failed to find expiring certs")
-	// Should get 001 and 003
+	// Should get 001 and 003, each as their own one-cert digest
 	test.AssertEquals(t, len(mc.Messages), 2)
 
-	test.AssertEquals(t, fmt.Sprintf(`hi, cert for DNS names example-a.com is going to expire in 1 days (%s)`, rawCertA.NotAfter.UTC().Format("2006-01-02 15:04:05 -0700 MST")), mc.Messages[0])
-	test.AssertEquals(t, fmt.Sprintf(`hi, cert for DNS names example-c.com is going to expire in 7 days (%s)`, rawCertC.NotAfter.UTC().Format("2006-01-02 15:04:05 -0700 MST")), mc.Messages[1])
+	test.AssertEquals(t, fmt.Sprintf("hi, cert for DNS names example-a.com is going to expire in 1 days (%s)\n", rawCertA.NotAfter.UTC().Format("2006-01-02 15:04:05 -0700 MST")), mc.Messages[0])
+	test.AssertEquals(t, fmt.Sprintf("hi, cert for DNS names example-c.com is going to expire in 7 days (%s)\n", rawCertC.NotAfter.UTC().Format("2006-01-02 15:04:05 -0700 MST")), mc.Messages[1])
 
-	// A consecutive run shouldn't find anything
+	// A consecutive run shouldn't find anything: the nag_events rows
+	// recorded above prevent re-sending even though LastExpirationNagSent
+	// wasn't updated on certificateStatus.
 	mc.Clear()
 	log.Clear()
 	err = m.findExpiringCertificates()
 	test.AssertNotError(t, err, "Failed to find expiring certs")
 	test.AssertEquals(t, len(mc.Messages), 0)
 }
+
+func TestFindExpiringCertificatesSkipsNagRecordOnSendFailure(t *testing.T) {
+	dbMap, err := sa.NewDbMap("sqlite3", ":memory:")
+	test.AssertNotError(t, err, "Couldn't connect to SQLite")
+	dbMap.AddTableWithName(nagEvent{}, "nag_events").SetKeys(false, "Serial", "NagWindow")
+	err = dbMap.CreateTablesIfNotExists()
+	test.AssertNotError(t, err, "Couldn't create tables")
+	tmpl, err := template.New("expiry-email").Parse(testTmpl)
+	test.AssertNotError(t, err, "Couldn't parse test email template")
+	stats, _ := statsd.NewNoopClient(nil)
+	mc := mockMail{err: fmt.Errorf("SMTP says no")}
+	m := mailer{
+		log:           blog.GetAuditLogger(),
+		stats:         stats,
+		mailer:        &mc,
+		emailTemplate: tmpl,
+		dbMap:         dbMap,
+		nagTimes:      []time.Duration{time.Hour * 24},
+		limit:         100,
+	}
+
+	email, _ := url.Parse("mailto:fails@mail.com")
+	var key jose.JsonWebKey
+	err = json.Unmarshal(jsonKeyA, &key)
+	test.AssertNotError(t, err, "Failed to unmarshal public JWK")
+	reg := &core.Registration{
+		ID:      1,
+		Contact: []core.AcmeURL{core.AcmeURL(*email)},
+		Key:     key,
+	}
+	rawCert := x509.Certificate{
+		Subject:      pkix.Name{CommonName: "sad"},
+		NotAfter:     time.Now().AddDate(0, 0, 1),
+		DNSNames:     []string{"example-sad.com"},
+		SerialNumber: big.NewInt(1337),
+	}
+	certDer, _ := x509.CreateCertificate(rand.Reader, &rawCert, &rawCert, &testKey.PublicKey, &testKey)
+	cert := &core.Certificate{
+		RegistrationID: 1,
+		Status:         core.StatusValid,
+		Serial:         "sad001",
+		Expires:        time.Now().AddDate(0, 0, 1),
+		DER:            certDer,
+	}
+	certStatus := &core.CertificateStatus{Serial: "sad001"}
+	test.AssertNotError(t, dbMap.Insert(reg), "Couldn't add reg")
+	test.AssertNotError(t, dbMap.Insert(cert), "Couldn't add cert")
+	test.AssertNotError(t, dbMap.Insert(certStatus), "Couldn't add certStatus")
+
+	err = m.findExpiringCertificates()
+	test.AssertError(t, err, "findExpiringCertificates should surface the SendMail failure")
+
+	already, err := m.alreadyNagged("sad001", m.nagTimes[0])
+	test.AssertNotError(t, err, "alreadyNagged lookup shouldn't fail")
+	test.Assert(t, !already, "a cert whose nag mail failed to send must not be recorded as nagged, so it's retried")
+}
+
+func TestCapCerts(t *testing.T) {
+	// A configured, positive limit smaller than the result set truncates.
+	test.AssertEquals(t, capCerts(10, 3), 3)
+	// A limit larger than the result set is a no-op.
+	test.AssertEquals(t, capCerts(3, 10), 3)
+	// An unconfigured (zero) limit must not truncate to zero certificates,
+	// or an upgraded deployment would silently stop sending nags.
+	test.AssertEquals(t, capCerts(10, 0), 10)
+	// A negative limit is likewise treated as unlimited.
+	test.AssertEquals(t, capCerts(10, -1), 10)
+}
+
+var jsonKeyA = []byte(`{
+  "kty":"RSA",
+  "n":"0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+  "e":"AQAB"
+}`)
+var jsonKeyB = []byte(`{
+  "kty":"RSA",
+  "n":"z8bp-jPtHt4lKBqepeKF28g_QAEOuEsCIou6sZ9ndsQsEjxEOQxQ0xNOQezsKa63eogw8YS3vzjUcPP5BJuVzfPfGd5NVUdT-vSSwxk3wvk_jtNqhrpcoG0elRPQfMVsQWmxCAXCVRz3xbcFI8GTe-syynG3l-g1IzYIIZVNI6jdljCZML1HOMTTW4f7uJJ8mM-08oQCeHbr5ejK7O2yMSSYxW03zY-Tj1iVEebROeMv6IEEJNFSS4yM-hLpNAqVuQxFGetwtwjDMC1Drs1dTWrPuUAAjKGrP151z1_dE74M5evpAhZUmpKv1hY-x85DC6N0hFPgowsanmTNNiV75w",
+  "e":"AAEAAQ"
+}`)
@@ -0,0 +1,51 @@
+// Copyright 2015 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// nagEvent records that a nag email covering (serial, nagWindow) has been
+// sent. Persisting this per-(serial, nagWindow), rather than just the
+// single LastExpirationNagSent timestamp on certificateStatus, means a
+// restart or clock skew can't cause a duplicate send, and operators can
+// ask "did registration X get its 24h warning for serial Y" directly.
+type nagEvent struct {
+	Serial    string    `db:"serial"`
+	NagWindow string    `db:"nagWindow"` // the nagWindow's String(), e.g. "24h0m0s"
+	SentAt    time.Time `db:"sentAt"`
+}
+
+// alreadyNagged reports whether a nag_events row already exists for
+// (serial, nagWindow).
+func (m *mailer) alreadyNagged(serial string, nagWindow time.Duration) (bool, error) {
+	var existing nagEvent
+	err := m.dbMap.SelectOne(&existing,
+		"SELECT * FROM nag_events WHERE serial = :serial AND nagWindow = :nagWindow",
+		map[string]interface{}{
+			"serial":    serial,
+			"nagWindow": nagWindow.String(),
+		})
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// recordNagSent inserts a nag_events row marking (serial, nagWindow) as
+// sent at sentAt.
+func (m *mailer) recordNagSent(serial string, nagWindow time.Duration, sentAt time.Time) error {
+	return m.dbMap.Insert(&nagEvent{
+		Serial:    serial,
+		NagWindow: nagWindow.String(),
+		SentAt:    sentAt,
+	})
+}
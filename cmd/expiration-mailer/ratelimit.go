@@ -0,0 +1,43 @@
+// Copyright 2015 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import "time"
+
+// tokenBucket is a simple token-bucket rate limiter used to keep outbound
+// SMTP under whatever rate the upstream mail provider allows.
+type tokenBucket struct {
+	tokens chan struct{}
+}
+
+// newTokenBucket returns a tokenBucket that refills to perSecond tokens
+// once a second and allows an initial burst of perSecond sends.
+func newTokenBucket(perSecond int) *tokenBucket {
+	tb := &tokenBucket{tokens: make(chan struct{}, perSecond)}
+	for i := 0; i < perSecond; i++ {
+		tb.tokens <- struct{}{}
+	}
+	go tb.refill(perSecond)
+	return tb
+}
+
+func (tb *tokenBucket) refill(perSecond int) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		for i := 0; i < perSecond; i++ {
+			select {
+			case tb.tokens <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// Take blocks until a token is available.
+func (tb *tokenBucket) Take() {
+	<-tb.tokens
+}
@@ -0,0 +1,41 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package core
+
+// IdentifierIP identifies an ACME authorization for a bare IP address,
+// as opposed to a DNS name. It is handled separately from IdentifierDNS
+// throughout the policy authority because an IP identifier can't be
+// validated with DNS-01: there's no zone to put a TXT record in.
+const IdentifierIP = IdentifierType("ip")
+
+// ChallengeTypeTLSALPN01 and ChallengeTypeIPHTTP01 identify the two
+// challenge types usable for IP-address identifiers, alongside the
+// existing simpleHttp/dvsni/dns challenge types.
+const (
+	ChallengeTypeTLSALPN01 = ChallengeType("tls-alpn-01")
+	ChallengeTypeIPHTTP01  = ChallengeType("ip-http-01")
+)
+
+// TLSALPNChallenge returns a new pending TLS-ALPN-01 challenge, offered
+// for IP identifiers, validated by having the subscriber serve a
+// self-signed certificate with the challenge response in a custom
+// extension over TLS on port 443.
+func TLSALPNChallenge() Challenge {
+	return Challenge{
+		Type:   ChallengeTypeTLSALPN01,
+		Status: StatusPending,
+	}
+}
+
+// IPHTTPChallenge returns a new pending IP-HTTP-01 challenge: the
+// IP-identifier analog of HTTP-01, validated by fetching a token over
+// HTTP from the IP address itself rather than from a DNS name.
+func IPHTTPChallenge() Challenge {
+	return Challenge{
+		Type:   ChallengeTypeIPHTTP01,
+		Status: StatusPending,
+	}
+}
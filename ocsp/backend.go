@@ -0,0 +1,37 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package ocsp defines the pluggable OCSP signing backend interface and
+// configuration boulder's OCSP responder and pre-signing worker are
+// built on, plus a caching SignerBackend wrapper that lets the responder
+// serve pre-signed responses without going back to a concrete backend
+// (and, in the PKCS#11 case, the HSM) on the request path. Concrete
+// backends (HSM-backed session pool, software key, remote signer) live
+// in their own subpackages so this package stays free of any particular
+// backend's dependencies.
+package ocsp
+
+import (
+	cfocsp "github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/cloudflare/cfssl/ocsp"
+)
+
+// SignerBackend is the interface a concrete OCSP signing mechanism must
+// implement. It is deliberately smaller than cfssl's ocsp.Signer: it
+// knows only how to produce a signed response for a single request,
+// report whether it is healthy, and shut itself down. Higher-level
+// concerns (parsing the incoming request, looking up certificate status,
+// caching) live here and in Signer implementations that wrap a
+// SignerBackend.
+type SignerBackend interface {
+	// Sign produces a signed OCSP response for req.
+	Sign(req cfocsp.SignRequest) ([]byte, error)
+	// HealthCheck returns a non-nil error if the backend cannot currently
+	// sign requests (e.g. an HSM session is down, or a remote signer is
+	// unreachable).
+	HealthCheck() error
+	// Close releases any resources (sessions, connections) held by the
+	// backend. After Close returns, Sign must not be called again.
+	Close() error
+}
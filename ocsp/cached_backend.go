@@ -0,0 +1,64 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ocsp
+
+import (
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/cactus/go-statsd-client/statsd"
+	cfocsp "github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/cloudflare/cfssl/ocsp"
+)
+
+// PreSignedLookup is the subset of a presign.ResponseStore the responder
+// path needs: a way to look up whatever the pre-signing worker already
+// produced for req, so the responder can avoid calling through to the
+// underlying SignerBackend (and, for the PKCS#11 backend, the HSM)
+// entirely on a cache hit.
+type PreSignedLookup interface {
+	// GetResponse returns the most recently stored pre-signed response
+	// for req, if one exists and hasn't passed its nextUpdate.
+	GetResponse(req cfocsp.SignRequest) (response []byte, ok bool, err error)
+}
+
+// CachingBackend is a SignerBackend that serves pre-signed responses
+// from a PreSignedLookup when one is available, and falls back to an
+// underlying SignerBackend only on a cache miss. HealthCheck and Close
+// are forwarded to the underlying backend, since the cache itself holds
+// no resources that need checking or releasing.
+type CachingBackend struct {
+	underlying SignerBackend
+	store      PreSignedLookup
+	stats      statsd.Statter
+}
+
+// NewCachingBackend wraps underlying with a pre-signed-response cache
+// backed by store.
+func NewCachingBackend(underlying SignerBackend, store PreSignedLookup, stats statsd.Statter) *CachingBackend {
+	return &CachingBackend{underlying: underlying, store: store, stats: stats}
+}
+
+// Sign returns the pre-signed response for req if the store has one,
+// without involving the underlying backend; otherwise it signs via the
+// underlying backend as usual.
+func (b *CachingBackend) Sign(req cfocsp.SignRequest) ([]byte, error) {
+	resp, ok, err := b.store.GetResponse(req)
+	if err != nil {
+		b.stats.Inc("OCSP.Responder.CacheLookupFailure", 1, 1.0)
+	} else if ok {
+		b.stats.Inc("OCSP.Responder.CacheHit", 1, 1.0)
+		return resp, nil
+	}
+	b.stats.Inc("OCSP.Responder.CacheMiss", 1, 1.0)
+	return b.underlying.Sign(req)
+}
+
+// HealthCheck reports the underlying backend's health.
+func (b *CachingBackend) HealthCheck() error {
+	return b.underlying.HealthCheck()
+}
+
+// Close tears down the underlying backend.
+func (b *CachingBackend) Close() error {
+	return b.underlying.Close()
+}
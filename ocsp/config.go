@@ -0,0 +1,35 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ocsp
+
+import (
+	"time"
+
+	cfconfig "github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/cloudflare/cfssl/ocsp/config"
+)
+
+// Config is the configuration for a pluggable OCSP SignerBackend: the
+// shared signer parameters cfssl's own OCSP config carries (CA cert, key
+// material reference, re-sign interval, PKCS#11 token parameters) plus
+// the boulder-specific pool and pre-signing-worker knobs none of the
+// concrete backends understand on their own.
+type Config struct {
+	cfconfig.Config
+
+	// Sessions is the number of concurrent PKCS#11 sessions the pool
+	// backend should maintain against the token. Defaults to 1.
+	Sessions int
+
+	// PreSignBatchSize is how many certificates the pre-signing worker
+	// fetches from the SA per iteration.
+	PreSignBatchSize int
+	// PreSignInterval is how often the pre-signing worker polls for
+	// newly-issued certificates to sign responses for.
+	PreSignInterval time.Duration
+	// RefreshBefore is how long before a pre-signed response's nextUpdate
+	// the worker should produce a replacement.
+	RefreshBefore time.Duration
+}
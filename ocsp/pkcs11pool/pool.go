@@ -0,0 +1,197 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package pkcs11pool implements a boulder ocsp.SignerBackend that
+// load-balances OCSP signing across a pool of concurrent PKCS#11
+// sessions against the same HSM token, transparently reconnecting an
+// individual session when the token reports CKR_SESSION_HANDLE_INVALID
+// or CKR_DEVICE_ERROR.
+package pkcs11pool
+
+import (
+	"crypto"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/cactus/go-statsd-client/statsd"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/cloudflare/cfssl/crypto/pkcs11key"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/cloudflare/cfssl/errors"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/cloudflare/cfssl/helpers"
+	cfocsp "github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/cloudflare/cfssl/ocsp"
+	"github.com/letsencrypt/boulder/ocsp"
+)
+
+// Enabled is set to true if PKCS #11 support is present.
+const Enabled = true
+
+// session is the subset of *pkcs11key.Key the pool depends on: something
+// that can sign and be torn down. Depending on this interface, rather
+// than *pkcs11key.Key directly, is what lets the round-robin/reconnect
+// bookkeeping below be exercised in tests without an HSM present.
+type session interface {
+	crypto.Signer
+	Close() error
+}
+
+// isSessionFatal reports whether err indicates the session handle itself
+// is no longer usable and should be torn down and reconnected, as
+// opposed to a transient signing failure that's safe to retry on the
+// same session.
+func isSessionFatal(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch err {
+	case pkcs11key.ErrSessionHandleInvalid, pkcs11key.ErrDeviceError:
+		return true
+	default:
+		return false
+	}
+}
+
+// Pool is a SignerBackend that load-balances signing requests across N
+// concurrent PKCS#11 sessions against the same token.
+type Pool struct {
+	mu       sync.Mutex
+	sessions []session
+	next     uint64
+
+	// newSession opens a fresh session against the configured token. It's
+	// a field, rather than a direct pkcs11key.New call, so reconnect can
+	// be unit tested with a fake.
+	newSession func() (session, error)
+	// newSigner wraps a session in the OCSP-protocol-aware cfssl Signer
+	// used to actually produce a response.
+	newSigner func(key crypto.Signer) (cfocsp.Signer, error)
+
+	stats statsd.Statter
+}
+
+// New returns a new pool-backed PKCS #11 OCSP SignerBackend. It opens
+// cfg.Sessions concurrent sessions against the configured token
+// (defaulting to a single session if unset) and round-robins signing
+// requests across them.
+func New(cfg ocsp.Config, stats statsd.Statter) (*Pool, error) {
+	certData, err := ioutil.ReadFile(cfg.CACertFile)
+	if err != nil {
+		return nil, errors.New(errors.CertificateError, errors.ReadFailed)
+	}
+	cert, err := helpers.ParseCertificatePEM(certData)
+	if err != nil {
+		return nil, err
+	}
+
+	PKCS11 := cfg.PKCS11
+	newSession := func() (session, error) {
+		return pkcs11key.New(PKCS11.Module, PKCS11.Token, PKCS11.PIN, PKCS11.Label)
+	}
+	newSigner := func(key crypto.Signer) (cfocsp.Signer, error) {
+		return cfocsp.NewSigner(cert, cert, key, cfg.Interval)
+	}
+
+	sessions := cfg.Sessions
+	if sessions < 1 {
+		sessions = 1
+	}
+	return newPool(sessions, newSession, newSigner, stats)
+}
+
+// newPool builds a Pool from already-constructed session/signer
+// factories, independent of how sessions are actually opened.
+func newPool(sessions int, newSession func() (session, error), newSigner func(crypto.Signer) (cfocsp.Signer, error), stats statsd.Statter) (*Pool, error) {
+	p := &Pool{
+		newSession: newSession,
+		newSigner:  newSigner,
+		stats:      stats,
+	}
+	for i := 0; i < sessions; i++ {
+		s, err := newSession()
+		if err != nil {
+			p.Close()
+			return nil, errors.New(errors.PrivateKeyError, errors.ReadFailed)
+		}
+		p.sessions = append(p.sessions, s)
+	}
+	return p, nil
+}
+
+// pickSession returns the next session to use, round-robin.
+func (p *Pool) pickSession() (int, session) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	i := int(atomic.AddUint64(&p.next, 1)-1) % len(p.sessions)
+	return i, p.sessions[i]
+}
+
+// reconnect replaces the session at index i with a freshly opened one.
+func (p *Pool) reconnect(i int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, err := p.newSession()
+	if err != nil {
+		p.stats.Inc("OCSP.Signer.PKCS11.ReconnectFailure", 1, 1.0)
+		return err
+	}
+	p.sessions[i] = s
+	p.stats.Inc("OCSP.Signer.PKCS11.Reconnected", 1, 1.0)
+	return nil
+}
+
+// Sign produces a signed OCSP response, load-balancing across the
+// session pool and transparently reconnecting on a fatal session error.
+func (p *Pool) Sign(req cfocsp.SignRequest) ([]byte, error) {
+	i, key := p.pickSession()
+
+	signer, err := p.newSigner(key)
+	if err != nil {
+		p.stats.Inc("OCSP.Signer.PKCS11.PoolExhaustion", 1, 1.0)
+		return nil, err
+	}
+
+	timer := p.stats.NewTiming("OCSP.Signer.PKCS11.SignLatency", 1.0)
+	resp, err := signer.Sign(req)
+	timer.Send()
+	if isSessionFatal(err) {
+		if reconnectErr := p.reconnect(i); reconnectErr != nil {
+			return nil, err
+		}
+		_, key = p.pickSession()
+		signer, sErr := p.newSigner(key)
+		if sErr != nil {
+			return nil, sErr
+		}
+		return signer.Sign(req)
+	}
+	return resp, err
+}
+
+// HealthCheck reports an error only when the pool holds no sessions, as
+// after Close. It does not probe whether the open sessions can still sign.
+func (p *Pool) HealthCheck() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.sessions) == 0 {
+		return errors.New(errors.PrivateKeyError, errors.Unknown)
+	}
+	return nil
+}
+
+// Close tears down every session held by the pool.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var firstErr error
+	for _, s := range p.sessions {
+		if s == nil {
+			continue
+		}
+		if err := s.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	p.sessions = nil
+	return firstErr
+}
@@ -0,0 +1,118 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package pkcs11pool
+
+import (
+	"crypto"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/cactus/go-statsd-client/statsd"
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/cloudflare/cfssl/crypto/pkcs11key"
+	cfocsp "github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/cloudflare/cfssl/ocsp"
+	"github.com/letsencrypt/boulder/test"
+)
+
+// fakeSession is a minimal crypto.Signer standing in for *pkcs11key.Key
+// in tests, so the pool's round-robin and reconnect bookkeeping can be
+// exercised without a real HSM.
+type fakeSession struct {
+	id     int
+	closed bool
+}
+
+func (s *fakeSession) Public() crypto.PublicKey { return nil }
+func (s *fakeSession) Sign(io.Reader, []byte, crypto.SignerOpts) ([]byte, error) {
+	return nil, nil
+}
+func (s *fakeSession) Close() error {
+	s.closed = true
+	return nil
+}
+
+// fakeSigner lets a test script the result of the next Sign call for a
+// given underlying session.
+type fakeSigner struct {
+	session *fakeSession
+	nextErr error
+}
+
+func (f *fakeSigner) Sign(req cfocsp.SignRequest) ([]byte, error) {
+	if f.nextErr != nil {
+		return nil, f.nextErr
+	}
+	return []byte("ok"), nil
+}
+
+func newTestPool(t *testing.T, sessionCount int) (*Pool, []*fakeSession, map[int]*fakeSigner) {
+	var sessions []*fakeSession
+	signers := make(map[int]*fakeSigner)
+	next := 0
+	newSession := func() (session, error) {
+		s := &fakeSession{id: next}
+		next++
+		sessions = append(sessions, s)
+		signer := &fakeSigner{session: s}
+		signers[s.id] = signer
+		return s, nil
+	}
+	newSigner := func(key crypto.Signer) (cfocsp.Signer, error) {
+		return signers[key.(*fakeSession).id], nil
+	}
+	stats, _ := statsd.NewNoopClient(nil)
+
+	p, err := newPool(sessionCount, newSession, newSigner, stats)
+	test.AssertNotError(t, err, "newPool should succeed")
+	return p, sessions, signers
+}
+
+func TestPoolRoundRobins(t *testing.T) {
+	p, sessions, _ := newTestPool(t, 3)
+
+	seen := map[int]bool{}
+	for i := 0; i < 3; i++ {
+		_, s := p.pickSession()
+		seen[s.(*fakeSession).id] = true
+	}
+	test.AssertEquals(t, len(seen), len(sessions))
+}
+
+func TestSignReconnectsOnFatalSessionError(t *testing.T) {
+	p, sessions, signers := newTestPool(t, 1)
+
+	signers[sessions[0].id].nextErr = pkcs11key.ErrSessionHandleInvalid
+
+	resp, err := p.Sign(cfocsp.SignRequest{})
+	test.AssertNotError(t, err, "Sign should transparently retry on the reconnected session")
+	test.AssertEquals(t, string(resp), "ok")
+
+	test.Assert(t, sessions[0].closed == false, "the original session struct isn't explicitly closed by reconnect")
+	test.AssertEquals(t, len(p.sessions), 1)
+	newSession, ok := p.sessions[0].(*fakeSession)
+	test.Assert(t, ok, "reconnected session should be a *fakeSession")
+	test.Assert(t, newSession.id != sessions[0].id, "reconnect should have replaced the session with a freshly opened one")
+}
+
+func TestSignDoesNotReconnectOnTransientError(t *testing.T) {
+	p, sessions, signers := newTestPool(t, 1)
+
+	transientErr := errors.New("temporary signing failure")
+	signers[sessions[0].id].nextErr = transientErr
+
+	_, err := p.Sign(cfocsp.SignRequest{})
+	test.AssertEquals(t, err, transientErr)
+	test.AssertEquals(t, len(p.sessions), 1)
+	test.AssertEquals(t, p.sessions[0].(*fakeSession).id, sessions[0].id)
+}
+
+func TestHealthCheckReflectsPoolState(t *testing.T) {
+	p, _, _ := newTestPool(t, 1)
+	test.AssertNotError(t, p.HealthCheck(), "a pool with an open session should be healthy")
+
+	test.AssertNotError(t, p.Close(), "Close should succeed")
+	test.AssertError(t, p.HealthCheck(), "a closed pool with no sessions should report unhealthy")
+}
@@ -0,0 +1,164 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package presign implements a background worker that produces OCSP
+// responses for recently-issued certificates ahead of time and stores
+// them so the responder can serve pre-signed bytes directly without
+// hitting the signer backend (and, in the PKCS#11 case, the HSM) on the
+// request path.
+package presign
+
+import (
+	"crypto/x509"
+	"time"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/cactus/go-statsd-client/statsd"
+	cfocsp "github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/cloudflare/cfssl/ocsp"
+	blog "github.com/letsencrypt/boulder/log"
+	"github.com/letsencrypt/boulder/ocsp"
+	"github.com/letsencrypt/boulder/sa"
+)
+
+// CertIterator yields recently-issued certificates that may need a
+// pre-signed OCSP response. sa.SA satisfies this by paging through newly
+// issued certificates.
+type CertIterator interface {
+	// RecentlyIssuedCertificates returns up to limit certificates issued
+	// since since, ordered oldest first.
+	RecentlyIssuedCertificates(since time.Time, limit int) ([]sa.CertificateWithID, error)
+}
+
+// StoredResponse describes a previously pre-signed OCSP response that may
+// be due for a refresh.
+type StoredResponse struct {
+	IssuerID    int64
+	Serial      string
+	Certificate *x509.Certificate
+	NextUpdate  time.Time
+}
+
+// ResponseStore persists pre-signed OCSP responses keyed by
+// (issuerID, serial) so the responder can look them up without signing,
+// and implements ocsp.PreSignedLookup so the responder's CachingBackend
+// can read them back by request.
+type ResponseStore interface {
+	ocsp.PreSignedLookup
+	StoreResponse(issuerID int64, serial string, response []byte, nextUpdate time.Time) error
+	// ExpiringResponses returns up to limit previously-stored responses
+	// whose nextUpdate falls before cutoff, so the worker can re-sign
+	// them ahead of going stale.
+	ExpiringResponses(cutoff time.Time, limit int) ([]StoredResponse, error)
+}
+
+// Worker periodically pre-signs OCSP responses for recently-issued
+// certificates, and re-signs previously pre-signed responses that are
+// approaching their nextUpdate, storing both via a ResponseStore.
+type Worker struct {
+	log      *blog.AuditLogger
+	stats    statsd.Statter
+	backend  ocsp.SignerBackend
+	certs    CertIterator
+	store    ResponseStore
+	issuerID int64
+
+	batchSize     int
+	interval      time.Duration
+	ocspInterval  time.Duration
+	refreshBefore time.Duration
+
+	lastSeen time.Time
+}
+
+// New constructs a pre-signing Worker. ocspInterval is the validity
+// period to stamp on each signed response's nextUpdate (ordinarily
+// cfg.Interval from the signer's own config); refreshBefore is how long
+// before that nextUpdate the worker should produce a replacement.
+func New(backend ocsp.SignerBackend, certs CertIterator, store ResponseStore, issuerID int64, batchSize int, interval, ocspInterval, refreshBefore time.Duration, stats statsd.Statter, log *blog.AuditLogger) *Worker {
+	return &Worker{
+		log:           log,
+		stats:         stats,
+		backend:       backend,
+		certs:         certs,
+		store:         store,
+		issuerID:      issuerID,
+		batchSize:     batchSize,
+		interval:      interval,
+		ocspInterval:  ocspInterval,
+		refreshBefore: refreshBefore,
+	}
+}
+
+// Run polls for newly-issued certificates every w.interval and pre-signs
+// OCSP responses for them. It blocks until stop is closed.
+func (w *Worker) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := w.tick(); err != nil {
+				w.log.Warning(err.Error())
+			}
+		}
+	}
+}
+
+// tick pre-signs responses for any newly-issued certificates, then
+// re-signs previously pre-signed responses that are within
+// w.refreshBefore of their nextUpdate. Without the second pass, every
+// response would be signed exactly once and silently go stale once its
+// nextUpdate passed.
+func (w *Worker) tick() error {
+	if err := w.presignNew(); err != nil {
+		return err
+	}
+	return w.refreshStale()
+}
+
+func (w *Worker) presignNew() error {
+	certs, err := w.certs.RecentlyIssuedCertificates(w.lastSeen, w.batchSize)
+	if err != nil {
+		return err
+	}
+	for _, c := range certs {
+		if err := w.signAndStore(w.issuerID, c.Serial, c.Certificate); err == nil && c.IssuedAt.After(w.lastSeen) {
+			w.lastSeen = c.IssuedAt
+		}
+	}
+	return nil
+}
+
+func (w *Worker) refreshStale() error {
+	stale, err := w.store.ExpiringResponses(time.Now().Add(w.refreshBefore), w.batchSize)
+	if err != nil {
+		return err
+	}
+	for _, r := range stale {
+		w.signAndStore(r.IssuerID, r.Serial, r.Certificate)
+	}
+	return nil
+}
+
+// signAndStore signs a fresh OCSP response for (serial, cert) and stores
+// it with a nextUpdate of w.ocspInterval from now.
+func (w *Worker) signAndStore(issuerID int64, serial string, cert *x509.Certificate) error {
+	resp, err := w.backend.Sign(cfocsp.SignRequest{
+		Certificate: cert,
+		Status:      cfocsp.Good,
+	})
+	if err != nil {
+		w.stats.Inc("OCSP.Presign.SignFailure", 1, 1.0)
+		return err
+	}
+	nextUpdate := time.Now().Add(w.ocspInterval)
+	if err := w.store.StoreResponse(issuerID, serial, resp, nextUpdate); err != nil {
+		w.stats.Inc("OCSP.Presign.StoreFailure", 1, 1.0)
+		return err
+	}
+	w.stats.Inc("OCSP.Presign.Signed", 1, 1.0)
+	return nil
+}
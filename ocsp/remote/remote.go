@@ -0,0 +1,74 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package remote provides a boulder ocsp.SignerBackend that delegates
+// OCSP signing to a remote signing service over gRPC, so the private key
+// never has to leave a single trusted signing host while multiple OCSP
+// responders share it.
+package remote
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	cfocsp "github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/cloudflare/cfssl/ocsp"
+)
+
+// signMethod and healthCheckMethod are the fully-qualified gRPC method
+// names exposed by the remote signing service. There's no generated
+// client stub for this service (it's a two-method internal protocol, not
+// worth a .proto/codegen round trip), so Signer invokes them directly
+// via the grpc.ClientConn.
+const (
+	signMethod        = "/ocsp.RemoteSigner/Sign"
+	healthCheckMethod = "/ocsp.RemoteSigner/HealthCheck"
+)
+
+// SignRequest and SignResponse are the wire types exchanged with the
+// remote signing service.
+type SignRequest struct {
+	Request cfocsp.SignRequest
+}
+
+// SignResponse carries the signed OCSP response bytes.
+type SignResponse struct {
+	Response []byte
+}
+
+// Signer is a SignerBackend that forwards signing requests to a remote
+// signing service over gRPC.
+type Signer struct {
+	conn *grpc.ClientConn
+}
+
+// New dials addr over gRPC and returns a remote-backed SignerBackend.
+func New(addr string) (*Signer, error) {
+	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	if err != nil {
+		return nil, err
+	}
+	return &Signer{conn: conn}, nil
+}
+
+// Sign forwards req to the remote signing service and returns the signed
+// OCSP response bytes it produces.
+func (s *Signer) Sign(req cfocsp.SignRequest) ([]byte, error) {
+	var resp SignResponse
+	if err := grpc.Invoke(context.Background(), signMethod, &SignRequest{Request: req}, &resp, s.conn); err != nil {
+		return nil, err
+	}
+	return resp.Response, nil
+}
+
+// HealthCheck pings the remote signing service.
+func (s *Signer) HealthCheck() error {
+	var reply struct{}
+	return grpc.Invoke(context.Background(), healthCheckMethod, &struct{}{}, &reply, s.conn)
+}
+
+// Close tears down the connection to the remote signing service.
+func (s *Signer) Close() error {
+	return s.conn.Close()
+}
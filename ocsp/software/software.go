@@ -0,0 +1,46 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package software provides a boulder ocsp.SignerBackend that signs OCSP
+// responses with an in-memory private key, for use in development and
+// tests where an HSM is unavailable.
+package software
+
+import (
+	"crypto"
+	"crypto/x509"
+
+	cfocsp "github.com/letsencrypt/boulder/Godeps/_workspace/src/github.com/cloudflare/cfssl/ocsp"
+)
+
+// Signer is a SignerBackend backed by an in-memory signing key.
+type Signer struct {
+	signer cfocsp.Signer
+}
+
+// New returns a software-key-backed SignerBackend.
+func New(cert, issuer *x509.Certificate, key crypto.Signer) (*Signer, error) {
+	s, err := cfocsp.NewSigner(cert, issuer, key, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &Signer{signer: s}, nil
+}
+
+// Sign produces a signed OCSP response.
+func (s *Signer) Sign(req cfocsp.SignRequest) ([]byte, error) {
+	return s.signer.Sign(req)
+}
+
+// HealthCheck always succeeds: an in-memory key has no external
+// dependency that can fail independently of the process itself.
+func (s *Signer) HealthCheck() error {
+	return nil
+}
+
+// Close is a no-op for the software backend.
+func (s *Signer) Close() error {
+	return nil
+}
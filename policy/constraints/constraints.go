@@ -0,0 +1,124 @@
+// Copyright 2015 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package constraints parses the X.509 Name Constraints extension
+// (RFC 5280 §4.2.1.10) from a CA's issuing chain and enforces those
+// constraints on identifiers independent of whether the issued
+// certificate itself encodes them. This protects against policy bugs
+// higher up the stack: even if a provisioner's policy would allow an
+// identifier, a technically-constrained sub-CA still can't be coerced
+// into issuing outside the bounds its parent established.
+package constraints
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// oidNameConstraints is the X.509 Name Constraints extension OID (RFC
+// 5280 §4.2.1.10), used to detect a constraint Go's x509 parser marked
+// critical but could not fully decode (see New).
+var oidNameConstraints = asn1.ObjectIdentifier{2, 5, 29, 30}
+
+// ConstraintsEngine evaluates identifiers against the Name Constraints
+// collected from an issuing chain.
+type ConstraintsEngine struct {
+	permittedDNSDomains []string
+	excludedDNSDomains  []string
+	permittedIPRanges   []*net.IPNet
+	excludedIPRanges    []*net.IPNet
+}
+
+// New builds a ConstraintsEngine from the Name Constraints present on any
+// CA certificate in chain; non-CA certificates are ignored. Constraints
+// from every CA certificate in the chain are unioned: a name must fall
+// within at least one permitted subtree declared anywhere in the chain
+// (if any is declared), and must not fall within any excluded subtree.
+// Permitted subtrees of different certificates are not intersected.
+//
+// New fails closed: if any CA certificate in chain carries a Name
+// Constraints extension marked critical that Go's x509 parser was unable
+// to fully evaluate (surfaced via UnhandledCriticalExtensions), we can't
+// be sure we've seen the complete permitted/excluded set, so New returns
+// an error rather than silently building an engine from a partial read.
+func New(chain []*x509.Certificate) (*ConstraintsEngine, error) {
+	ce := &ConstraintsEngine{}
+	for _, cert := range chain {
+		if !cert.IsCA {
+			continue
+		}
+		for _, oid := range cert.UnhandledCriticalExtensions {
+			if oid.Equal(oidNameConstraints) {
+				return nil, fmt.Errorf("constraints: certificate %q has a name constraints extension that could not be fully parsed", cert.Subject)
+			}
+		}
+		ce.permittedDNSDomains = append(ce.permittedDNSDomains, cert.PermittedDNSDomains...)
+		ce.excludedDNSDomains = append(ce.excludedDNSDomains, cert.ExcludedDNSDomains...)
+		ce.permittedIPRanges = append(ce.permittedIPRanges, cert.PermittedIPRanges...)
+		ce.excludedIPRanges = append(ce.excludedIPRanges, cert.ExcludedIPRanges...)
+	}
+	return ce, nil
+}
+
+// labelSuffixMatch implements the RFC 5280 §4.2.1.10 comparison rule: a
+// domain matches a constraint if it is an exact (case-insensitive) match,
+// or if the constraint is a parent domain immediately preceded by a ".".
+// A constraint with a leading "." only matches as a subdomain, never the
+// bare domain itself.
+func labelSuffixMatch(domain, constraint string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	constraint = strings.ToLower(strings.TrimSuffix(constraint, "."))
+
+	if strings.HasPrefix(constraint, ".") {
+		return strings.HasSuffix(domain, constraint)
+	}
+	if domain == constraint {
+		return true
+	}
+	return strings.HasSuffix(domain, "."+constraint)
+}
+
+// CheckDNS returns an error if domain falls outside the permitted DNS
+// subtrees (when any are declared) or within an excluded subtree.
+func (ce *ConstraintsEngine) CheckDNS(domain string) error {
+	for _, excluded := range ce.excludedDNSDomains {
+		if labelSuffixMatch(domain, excluded) {
+			return fmt.Errorf("constraints: %q is excluded by name constraint %q", domain, excluded)
+		}
+	}
+
+	if len(ce.permittedDNSDomains) == 0 {
+		return nil
+	}
+	for _, permitted := range ce.permittedDNSDomains {
+		if labelSuffixMatch(domain, permitted) {
+			return nil
+		}
+	}
+	return fmt.Errorf("constraints: %q is not in any permitted name constraint subtree", domain)
+}
+
+// CheckIP returns an error if ip falls outside the permitted IP ranges
+// (when any are declared) or within an excluded range.
+func (ce *ConstraintsEngine) CheckIP(ip net.IP) error {
+	for _, excluded := range ce.excludedIPRanges {
+		if excluded.Contains(ip) {
+			return fmt.Errorf("constraints: %s is excluded by name constraint %s", ip, excluded)
+		}
+	}
+
+	if len(ce.permittedIPRanges) == 0 {
+		return nil
+	}
+	for _, permitted := range ce.permittedIPRanges {
+		if permitted.Contains(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("constraints: %s is not in any permitted name constraint range", ip)
+}
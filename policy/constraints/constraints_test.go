@@ -0,0 +1,105 @@
+// Copyright 2015 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package constraints
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"net"
+	"testing"
+
+	"github.com/letsencrypt/boulder/test"
+)
+
+func mustParseCIDR(t *testing.T, s string) *net.IPNet {
+	_, ipNet, err := net.ParseCIDR(s)
+	test.AssertNotError(t, err, "failed to parse test CIDR "+s)
+	return ipNet
+}
+
+func TestCheckDNSPermitted(t *testing.T) {
+	ce := &ConstraintsEngine{
+		permittedDNSDomains: []string{"example.com"},
+	}
+	test.AssertNotError(t, ce.CheckDNS("example.com"), "bare permitted domain should be allowed")
+	test.AssertNotError(t, ce.CheckDNS("foo.example.com"), "subdomain of permitted domain should be allowed")
+	test.AssertError(t, ce.CheckDNS("evil.com"), "domain outside the permitted subtree should be rejected")
+}
+
+func TestCheckDNSExcludedWins(t *testing.T) {
+	ce := &ConstraintsEngine{
+		permittedDNSDomains: []string{"example.com"},
+		excludedDNSDomains:  []string{"bad.example.com"},
+	}
+	test.AssertNotError(t, ce.CheckDNS("good.example.com"), "non-excluded subdomain should be allowed")
+	test.AssertError(t, ce.CheckDNS("bad.example.com"), "excluded subdomain should be rejected even though the parent is permitted")
+	test.AssertError(t, ce.CheckDNS("host.bad.example.com"), "descendant of an excluded subdomain should be rejected")
+}
+
+func TestCheckDNSNoConstraints(t *testing.T) {
+	ce := &ConstraintsEngine{}
+	test.AssertNotError(t, ce.CheckDNS("anything.example.net"), "absent constraints should permit anything not excluded")
+}
+
+func TestCheckIP(t *testing.T) {
+	ce := &ConstraintsEngine{
+		permittedIPRanges: []*net.IPNet{mustParseCIDR(t, "10.0.0.0/8")},
+		excludedIPRanges:  []*net.IPNet{mustParseCIDR(t, "10.1.0.0/16")},
+	}
+	test.AssertNotError(t, ce.CheckIP(net.ParseIP("10.2.3.4")), "IP in permitted range should be allowed")
+	test.AssertError(t, ce.CheckIP(net.ParseIP("10.1.2.3")), "IP in excluded sub-range should be rejected")
+	test.AssertError(t, ce.CheckIP(net.ParseIP("192.168.1.1")), "IP outside permitted range should be rejected")
+}
+
+func TestNewUnionsChainConstraints(t *testing.T) {
+	root := &x509.Certificate{
+		IsCA:                true,
+		PermittedDNSDomains: []string{"example.com"},
+	}
+	intermediate := &x509.Certificate{
+		IsCA:               true,
+		ExcludedDNSDomains: []string{"bad.example.com"},
+	}
+	leaf := &x509.Certificate{
+		IsCA: false,
+		// Constraints on a non-CA leaf must be ignored.
+		PermittedDNSDomains: []string{"ignored.example.org"},
+	}
+
+	ce, err := New([]*x509.Certificate{root, intermediate, leaf})
+	test.AssertNotError(t, err, "New should not error on a well-formed chain")
+
+	test.AssertNotError(t, ce.CheckDNS("ok.example.com"), "union of chain constraints should permit this")
+	test.AssertError(t, ce.CheckDNS("bad.example.com"), "union of chain constraints should exclude this")
+	test.AssertError(t, ce.CheckDNS("ignored.example.org"), "constraints on a non-CA leaf must not be honored")
+}
+
+func TestNewRejectsMalformedConstraintsExtension(t *testing.T) {
+	intermediate := &x509.Certificate{
+		IsCA:                true,
+		PermittedDNSDomains: []string{"example.com"},
+		UnhandledCriticalExtensions: []asn1.ObjectIdentifier{
+			oidNameConstraints,
+		},
+	}
+
+	_, err := New([]*x509.Certificate{intermediate})
+	test.AssertError(t, err, "a name constraints extension Go's parser couldn't fully decode must be rejected, not silently ignored")
+}
+
+func TestNewIgnoresUnrelatedUnhandledExtensions(t *testing.T) {
+	intermediate := &x509.Certificate{
+		IsCA:                true,
+		PermittedDNSDomains: []string{"example.com"},
+		UnhandledCriticalExtensions: []asn1.ObjectIdentifier{
+			{1, 2, 3, 4}, // some other critical extension we don't understand
+		},
+	}
+
+	ce, err := New([]*x509.Certificate{intermediate})
+	test.AssertNotError(t, err, "an unhandled critical extension unrelated to name constraints must not cause New to fail")
+	test.AssertNotError(t, ce.CheckDNS("foo.example.com"), "constraints should still be usable")
+}
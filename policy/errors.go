@@ -0,0 +1,56 @@
+// Copyright 2015 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package policy
+
+import "fmt"
+
+// NamePolicyReason enumerates the reasons an identifier can be refused by
+// the name policy engine.
+type NamePolicyReason string
+
+const (
+	// NotAllowed means the identifier did not match any allow rule for the
+	// policy in question (global or per-account), fell in a reserved IP
+	// range, or fell outside the issuing chain's name constraints.
+	NotAllowed NamePolicyReason = "NotAllowed"
+	// Blocked means the identifier matched an explicit deny rule.
+	Blocked NamePolicyReason = "Blocked"
+	// CannotParseDomain means the identifier's value could not be parsed as
+	// a DNS name.
+	CannotParseDomain NamePolicyReason = "CannotParseDomain"
+	// CannotParseIP means the identifier's value could not be parsed as an
+	// IP address.
+	CannotParseIP NamePolicyReason = "CannotParseIP"
+	// NotPublic means the identifier does not end in a public suffix.
+	NotPublic NamePolicyReason = "NotPublic"
+)
+
+// NamePolicyError is returned by WillingToIssue and WillingToIssueForAccount
+// whenever a name policy rule rejects an identifier. It carries enough
+// structure for callers (notably the WFE) to build an RFC 8555 problem
+// document that names the offending identifier.
+type NamePolicyError struct {
+	Reason     NamePolicyReason
+	Detail     string
+	Identifier string
+}
+
+func (e *NamePolicyError) Error() string {
+	if e.Detail == "" {
+		return fmt.Sprintf("policy: %s: %s", e.Reason, e.Identifier)
+	}
+	return fmt.Sprintf("policy: %s: %s (%s)", e.Reason, e.Identifier, e.Detail)
+}
+
+// InvalidIdentifierError indicates that we didn't understand the IdentifierType
+// provided.
+type InvalidIdentifierError struct{}
+
+// SyntaxError indicates that the user input was not well formatted.
+type SyntaxError struct{}
+
+func (e InvalidIdentifierError) Error() string { return "Invalid identifier type" }
+func (e SyntaxError) Error() string            { return "Syntax error" }
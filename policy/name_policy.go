@@ -0,0 +1,239 @@
+// Copyright 2015 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/letsencrypt/boulder/Godeps/_workspace/src/golang.org/x/net/idna"
+)
+
+// RuleSet is a set of allow/deny rules evaluated against an identifier.
+// An empty Allowed list means "allow anything not explicitly denied."
+// Deny rules always win over allow rules.
+//
+// A plain entry in AllowedDNSNames/DeniedDNSNames (e.g. "example.com")
+// covers that literal name AND every subdomain of it, the same as a
+// "*.example.com" wildcard entry plus the bare name. There's no way to
+// match only the literal FQDN and leave its subdomains unaffected; use a
+// wildcard entry on its own if only subdomains, and not the bare name,
+// should be covered.
+type RuleSet struct {
+	AllowedDNSNames []string `json:"allowedDNSNames,omitempty"`
+	DeniedDNSNames  []string `json:"deniedDNSNames,omitempty"`
+	AllowedIPRanges []string `json:"allowedIPRanges,omitempty"`
+	DeniedIPRanges  []string `json:"deniedIPRanges,omitempty"`
+}
+
+// compiledRuleSet is a RuleSet with its IP ranges pre-parsed into
+// *net.IPNet so evaluation doesn't re-parse CIDRs on every call.
+type compiledRuleSet struct {
+	allowedDNSNames []string
+	deniedDNSNames  []string
+	allowedIPRanges []*net.IPNet
+	deniedIPRanges  []*net.IPNet
+}
+
+// NamePolicyConfig is the on-disk JSON representation of a NamePolicy: a
+// global RuleSet plus any number of per-registration overlay RuleSets.
+// NewNamePolicy parses JSON only; there is no YAML loader.
+type NamePolicyConfig struct {
+	Global      RuleSet            `json:"global"`
+	PerAccount  map[string]RuleSet `json:"perAccount,omitempty"` // keyed by registration ID, e.g. "1001"
+	CAHostnames []string           `json:"caHostnames,omitempty"`
+}
+
+// NamePolicy is a pluggable allow/deny policy engine. It is constructed
+// from a NamePolicyConfig and layers a global policy with optional
+// per-registration overlay policies.
+type NamePolicy struct {
+	global     compiledRuleSet
+	perAccount map[string]compiledRuleSet
+}
+
+// compileRuleSet lower-cases and pre-parses a RuleSet.
+func compileRuleSet(rs RuleSet) (compiledRuleSet, error) {
+	var crs compiledRuleSet
+	for _, n := range rs.AllowedDNSNames {
+		crs.allowedDNSNames = append(crs.allowedDNSNames, strings.ToLower(n))
+	}
+	for _, n := range rs.DeniedDNSNames {
+		crs.deniedDNSNames = append(crs.deniedDNSNames, strings.ToLower(n))
+	}
+	for _, cidr := range rs.AllowedIPRanges {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return crs, fmt.Errorf("policy: invalid allowed IP range %q: %s", cidr, err)
+		}
+		crs.allowedIPRanges = append(crs.allowedIPRanges, ipNet)
+	}
+	for _, cidr := range rs.DeniedIPRanges {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return crs, fmt.Errorf("policy: invalid denied IP range %q: %s", cidr, err)
+		}
+		crs.deniedIPRanges = append(crs.deniedIPRanges, ipNet)
+	}
+	return crs, nil
+}
+
+// NewNamePolicy parses the given JSON config and builds a NamePolicy,
+// consulting caHostnames (the CA's own hostnames, e.g. the ACME server
+// name) to lint the resulting policy.
+func NewNamePolicy(configJSON []byte) (*NamePolicy, error) {
+	var cfg NamePolicyConfig
+	if err := json.Unmarshal(configJSON, &cfg); err != nil {
+		return nil, fmt.Errorf("policy: couldn't parse name policy config: %s", err)
+	}
+	return NewNamePolicyFromConfig(cfg)
+}
+
+// NewNamePolicyFromConfig builds a NamePolicy from an already-parsed
+// NamePolicyConfig, lint-checking it against cfg.CAHostnames.
+func NewNamePolicyFromConfig(cfg NamePolicyConfig) (*NamePolicy, error) {
+	global, err := compileRuleSet(cfg.Global)
+	if err != nil {
+		return nil, err
+	}
+	np := &NamePolicy{
+		global:     global,
+		perAccount: make(map[string]compiledRuleSet),
+	}
+	for regID, rs := range cfg.PerAccount {
+		crs, err := compileRuleSet(rs)
+		if err != nil {
+			return nil, fmt.Errorf("policy: per-account rules for %s: %s", regID, err)
+		}
+		np.perAccount[regID] = crs
+	}
+
+	for _, hostname := range cfg.CAHostnames {
+		if err := np.checkDNSName(np.global, hostname); err != nil {
+			return nil, fmt.Errorf("policy: refusing to install a policy that would lock out the CA's own hostname %q: %s", hostname, err)
+		}
+	}
+
+	return np, nil
+}
+
+// normalizeDomain lower-cases a domain and converts any IDNA labels to
+// their ASCII (punycode) form so comparisons are consistent regardless of
+// how the identifier was submitted.
+func normalizeDomain(domain string) (string, error) {
+	ascii, err := idna.ToASCII(strings.ToLower(domain))
+	if err != nil {
+		return "", err
+	}
+	return ascii, nil
+}
+
+// dnsSuffixMatch reports whether name is an exact match, or a subdomain
+// of, one of the entries in rules. A leading "*." on a rule anchors the
+// match to proper subdomains only (it will not match the bare domain);
+// a plain entry matches both the bare domain and any of its subdomains.
+func dnsSuffixMatch(name string, rules []string) bool {
+	for _, rule := range rules {
+		if strings.HasPrefix(rule, "*.") {
+			suffix := rule[1:] // keep the leading dot, e.g. ".example.com"
+			if strings.HasSuffix(name, suffix) {
+				return true
+			}
+			continue
+		}
+		if name == rule {
+			return true
+		}
+		if strings.HasSuffix(name, "."+rule) {
+			return true
+		}
+	}
+	return false
+}
+
+func ipInRanges(ip net.IP, ranges []*net.IPNet) bool {
+	for _, r := range ranges {
+		if r.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDNSName evaluates a single RuleSet against a DNS identifier.
+func (np *NamePolicy) checkDNSName(rs compiledRuleSet, domain string) error {
+	name, err := normalizeDomain(domain)
+	if err != nil {
+		return &NamePolicyError{Reason: CannotParseDomain, Detail: err.Error(), Identifier: domain}
+	}
+
+	if dnsSuffixMatch(name, rs.deniedDNSNames) {
+		return &NamePolicyError{Reason: Blocked, Identifier: domain}
+	}
+
+	if len(rs.allowedDNSNames) > 0 && !dnsSuffixMatch(name, rs.allowedDNSNames) {
+		return &NamePolicyError{Reason: NotAllowed, Identifier: domain}
+	}
+
+	return nil
+}
+
+// checkIP evaluates a single RuleSet against an IP identifier.
+func (np *NamePolicy) checkIP(rs compiledRuleSet, value string) error {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return &NamePolicyError{Reason: CannotParseIP, Identifier: value}
+	}
+
+	if ipInRanges(ip, rs.deniedIPRanges) {
+		return &NamePolicyError{Reason: Blocked, Identifier: value}
+	}
+
+	if len(rs.allowedIPRanges) > 0 && !ipInRanges(ip, rs.allowedIPRanges) {
+		return &NamePolicyError{Reason: NotAllowed, Identifier: value}
+	}
+
+	return nil
+}
+
+// WillingToIssue evaluates only the global RuleSet for domain.
+func (np *NamePolicy) WillingToIssue(domain string) error {
+	return np.checkDNSName(np.global, domain)
+}
+
+// WillingToIssueIP evaluates only the global RuleSet for an IP identifier.
+func (np *NamePolicy) WillingToIssueIP(value string) error {
+	return np.checkIP(np.global, value)
+}
+
+// WillingToIssueForAccount evaluates the global RuleSet AND, if one is
+// configured, the per-registration overlay RuleSet for regID. The
+// identifier must pass both.
+func (np *NamePolicy) WillingToIssueForAccount(domain string, regID int64) error {
+	if err := np.WillingToIssue(domain); err != nil {
+		return err
+	}
+	overlay, ok := np.perAccount[fmt.Sprintf("%d", regID)]
+	if !ok {
+		return nil
+	}
+	return np.checkDNSName(overlay, domain)
+}
+
+// WillingToIssueIPForAccount is the IP-identifier analog of
+// WillingToIssueForAccount.
+func (np *NamePolicy) WillingToIssueIPForAccount(value string, regID int64) error {
+	if err := np.WillingToIssueIP(value); err != nil {
+		return err
+	}
+	overlay, ok := np.perAccount[fmt.Sprintf("%d", regID)]
+	if !ok {
+		return nil
+	}
+	return np.checkIP(overlay, value)
+}
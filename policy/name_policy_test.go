@@ -0,0 +1,117 @@
+// Copyright 2015 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package policy
+
+import (
+	"testing"
+
+	"github.com/letsencrypt/boulder/test"
+)
+
+func TestWillingToIssueEmptyAllowMeansAllowAll(t *testing.T) {
+	np, err := NewNamePolicyFromConfig(NamePolicyConfig{})
+	test.AssertNotError(t, err, "empty config should compile")
+
+	test.AssertNotError(t, np.WillingToIssue("example.com"), "empty allow list should permit anything")
+	test.AssertNotError(t, np.WillingToIssue("sub.example.net"), "empty allow list should permit anything")
+}
+
+func TestWillingToIssueDenyWins(t *testing.T) {
+	np, err := NewNamePolicyFromConfig(NamePolicyConfig{
+		Global: RuleSet{
+			AllowedDNSNames: []string{"example.com"},
+			DeniedDNSNames:  []string{"bad.example.com"},
+		},
+	})
+	test.AssertNotError(t, err, "config should compile")
+
+	test.AssertNotError(t, np.WillingToIssue("example.com"), "allowed domain should be permitted")
+	test.AssertError(t, np.WillingToIssue("bad.example.com"), "denied subdomain should be rejected even though the parent is allowed")
+	test.AssertError(t, np.WillingToIssue("other.com"), "domain outside the allow list should be rejected")
+}
+
+func TestWillingToIssueForAccountOverlay(t *testing.T) {
+	np, err := NewNamePolicyFromConfig(NamePolicyConfig{
+		Global: RuleSet{
+			AllowedDNSNames: []string{"example.com"},
+		},
+		PerAccount: map[string]RuleSet{
+			"1001": {
+				DeniedDNSNames: []string{"internal.example.com"},
+			},
+		},
+	})
+	test.AssertNotError(t, err, "config should compile")
+
+	test.AssertNotError(t, np.WillingToIssueForAccount("foo.example.com", 1001), "globally allowed domain with no per-account denial should be permitted")
+	test.AssertError(t, np.WillingToIssueForAccount("internal.example.com", 1001), "domain denied by the per-account overlay should be rejected for that account")
+	test.AssertNotError(t, np.WillingToIssueForAccount("internal.example.com", 2002), "the per-account overlay must not apply to other accounts")
+	test.AssertError(t, np.WillingToIssueForAccount("evil.com", 1001), "global allow list should still be enforced for an account with an overlay")
+}
+
+func TestWillingToIssueIPDenyWins(t *testing.T) {
+	np, err := NewNamePolicyFromConfig(NamePolicyConfig{
+		Global: RuleSet{
+			AllowedIPRanges: []string{"203.0.113.0/24"},
+			DeniedIPRanges:  []string{"203.0.113.128/25"},
+		},
+	})
+	test.AssertNotError(t, err, "config should compile")
+
+	test.AssertNotError(t, np.WillingToIssueIP("203.0.113.1"), "IP in the allowed range should be permitted")
+	test.AssertError(t, np.WillingToIssueIP("203.0.113.200"), "IP in the denied sub-range should be rejected")
+	test.AssertError(t, np.WillingToIssueIP("198.51.100.1"), "IP outside the allowed range should be rejected")
+}
+
+func TestNormalizeDomainHandlesIDN(t *testing.T) {
+	ascii, err := normalizeDomain("Königsgäßchen.example.com")
+	test.AssertNotError(t, err, "a valid IDN label should normalize without error")
+	test.AssertEquals(t, ascii, "xn--knigsgsschen-lcb0w.example.com")
+}
+
+func TestWillingToIssuePlainRuleCoversSubdomains(t *testing.T) {
+	// A plain (non-wildcard) rule entry is deliberately not a pure
+	// exact-FQDN match: it also covers every subdomain of the named
+	// domain, the same as pairing it with a "*.example.com" wildcard.
+	// There's no syntax for "this literal name only" today; this test
+	// pins that down so it can't regress unnoticed.
+	np, err := NewNamePolicyFromConfig(NamePolicyConfig{
+		Global: RuleSet{
+			AllowedDNSNames: []string{"example.com"},
+			DeniedDNSNames:  []string{"example.net"},
+		},
+	})
+	test.AssertNotError(t, err, "config should compile")
+
+	test.AssertNotError(t, np.WillingToIssue("example.com"), "the literal allowed name should be permitted")
+	test.AssertNotError(t, np.WillingToIssue("deeply.nested.example.com"), "a plain allow entry also covers its subdomains")
+	test.AssertError(t, np.WillingToIssue("example.net"), "the literal denied name should be rejected")
+	test.AssertError(t, np.WillingToIssue("www.example.net"), "a plain deny entry also covers its subdomains")
+}
+
+func TestWillingToIssueWildcardRuleExcludesBareDomain(t *testing.T) {
+	// A "*.example.org" entry, unlike a plain entry, covers only proper
+	// subdomains and deliberately excludes the bare domain itself.
+	np, err := NewNamePolicyFromConfig(NamePolicyConfig{
+		Global: RuleSet{
+			AllowedDNSNames: []string{"*.example.org"},
+		},
+	})
+	test.AssertNotError(t, err, "config should compile")
+
+	test.AssertNotError(t, np.WillingToIssue("www.example.org"), "a subdomain should be permitted by the wildcard entry")
+	test.AssertError(t, np.WillingToIssue("example.org"), "the bare domain should not be permitted by a wildcard-only entry")
+}
+
+func TestNewNamePolicyFromConfigRejectsLockingOutCA(t *testing.T) {
+	_, err := NewNamePolicyFromConfig(NamePolicyConfig{
+		Global: RuleSet{
+			DeniedDNSNames: []string{"ca.example.com"},
+		},
+		CAHostnames: []string{"ca.example.com"},
+	})
+	test.AssertError(t, err, "a policy that would deny the CA's own hostname must be rejected at construction time")
+}
@@ -6,6 +6,7 @@
 package policy
 
 import (
+	"crypto/x509"
 	"fmt"
 	"net"
 	"regexp"
@@ -13,6 +14,7 @@ import (
 
 	"github.com/letsencrypt/boulder/core"
 	blog "github.com/letsencrypt/boulder/log"
+	"github.com/letsencrypt/boulder/policy/constraints"
 )
 
 // PolicyAuthorityImpl enforces CA policy decisions.
@@ -21,10 +23,36 @@ type PolicyAuthorityImpl struct {
 
 	PublicSuffixList map[string]bool // A copy of the DNS root zone
 	Blacklist        map[string]bool // A blacklist of denied names
+
+	// NamePolicy, when non-nil, is consulted in addition to the
+	// PublicSuffixList/Blacklist checks above: it layers a configurable
+	// global allow/deny policy with optional per-registration overlays.
+	NamePolicy *NamePolicy
+
+	// constraints, when non-nil, enforces the X.509 Name Constraints
+	// extension found on the issuing chain, independent of whatever the
+	// NamePolicy or blacklist above would otherwise allow. This lets a
+	// technically-constrained sub-CA reject issuance a bug elsewhere in
+	// policy would have permitted.
+	constraints *constraints.ConstraintsEngine
+
+	// AllowInternalAddresses, when true, permits issuance for IP
+	// identifiers in the reserved/private/loopback/link-local ranges
+	// (RFC 1918, RFC 4193, RFC 6890). It exists for CAs run for internal
+	// infrastructure use; the public default is false.
+	AllowInternalAddresses bool
+
+	// DeniedIPRanges is an operator-configured set of CIDRs that IP
+	// identifiers are checked against regardless of AllowInternalAddresses.
+	DeniedIPRanges []*net.IPNet
 }
 
-// NewPolicyAuthorityImpl constructs a Policy Authority.
-func NewPolicyAuthorityImpl() *PolicyAuthorityImpl {
+// NewPolicyAuthorityImpl constructs a Policy Authority. chain is the CA's
+// issuing intermediate certificate chain (root-to-leaf or leaf-to-root,
+// order does not matter); any Name Constraints it carries are parsed and
+// enforced by WillingToIssue. Pass a nil chain if the issuing chain
+// carries no constraints to enforce.
+func NewPolicyAuthorityImpl(chain []*x509.Certificate) (*PolicyAuthorityImpl, error) {
 	logger := blog.GetAuditLogger()
 	logger.Notice("Policy Authority Starting")
 
@@ -34,11 +62,51 @@ func NewPolicyAuthorityImpl() *PolicyAuthorityImpl {
 	pa.PublicSuffixList = PublicSuffixList
 	pa.Blacklist = blacklist
 
-	return &pa
+	ce, err := constraints.New(chain)
+	if err != nil {
+		return nil, fmt.Errorf("policy: couldn't build name constraints engine: %s", err)
+	}
+	pa.constraints = ce
+
+	return &pa, nil
+}
+
+// SetNamePolicy installs a NamePolicy engine on the PolicyAuthorityImpl.
+// It is split out from the constructor so that operators can reload policy
+// config (e.g. on SIGHUP) without tearing down the PolicyAuthorityImpl.
+func (pa *PolicyAuthorityImpl) SetNamePolicy(np *NamePolicy) {
+	pa.NamePolicy = np
 }
 
 const maxLabels = 10
 
+// reservedIPRanges are the non-public IPv4/IPv6 ranges we refuse to issue
+// for unless AllowInternalAddresses is set: RFC 1918 private-use, RFC 4193
+// unique-local, and the various RFC 6890 special-purpose ranges
+// (loopback, link-local, etc).
+var reservedIPRanges = mustParseCIDRs(
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"fc00::/7",
+	"::1/128",
+	"fe80::/10",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = ipNet
+	}
+	return nets
+}
+
 var dnsLabelRegexp = regexp.MustCompile("^[a-zA-Z0-9][a-zA-Z0-9-]{0,62}$")
 var punycodeRegexp = regexp.MustCompile("^xn--")
 
@@ -85,25 +153,6 @@ func (pa PolicyAuthorityImpl) PSLPlusOne(domain string) (string, error) {
 	return "", fmt.Errorf("Reached unreachable point in PSLPlusOne")
 }
 
-// InvalidIdentifierError indicates that we didn't understand the IdentifierType
-// provided.
-type InvalidIdentifierError struct{}
-
-// SyntaxError indicates that the user input was not well formatted.
-type SyntaxError struct{}
-
-// NonPublicError indicates that one or more identifiers were not on the public
-// Internet.
-type NonPublicError struct{}
-
-// BlacklistedError indicates we have blacklisted one or more of these identifiers.
-type BlacklistedError struct{}
-
-func (e InvalidIdentifierError) Error() string { return "Invalid identifier type" }
-func (e SyntaxError) Error() string            { return "Syntax error" }
-func (e NonPublicError) Error() string         { return "Name does not end in a public suffix" }
-func (e BlacklistedError) Error() string       { return "Name is blacklisted" }
-
 // WillingToIssue determines whether the CA is willing to issue for the provided
 // identifier.
 //
@@ -128,6 +177,11 @@ func (e BlacklistedError) Error() string       { return "Name is blacklisted" }
 //
 // XXX: We should probably fold everything to lower-case somehow.
 func (pa PolicyAuthorityImpl) WillingToIssue(id core.AcmeIdentifier) error {
+	// IP identifiers are the one exception to the DNS-only rule above;
+	// they are checked by willingToIssueIP instead of these criteria.
+	if id.Type == core.IdentifierIP {
+		return pa.willingToIssueIP(id)
+	}
 	if id.Type != core.IdentifierDNS {
 		return InvalidIdentifierError{}
 	}
@@ -170,22 +224,110 @@ func (pa PolicyAuthorityImpl) WillingToIssue(id core.AcmeIdentifier) error {
 
 	// Require match to PSL, plus at least one label
 	if !suffixMatch(labels, pa.PublicSuffixList, true) {
-		return NonPublicError{}
+		return &NamePolicyError{Reason: NotPublic, Identifier: id.Value}
 	}
 
 	// Require no match against blacklist
 	if suffixMatch(labels, pa.Blacklist, false) {
-		return BlacklistedError{}
+		return &NamePolicyError{Reason: Blocked, Identifier: id.Value}
+	}
+
+	// Consult the pluggable global allow/deny policy, if one is installed.
+	if pa.NamePolicy != nil {
+		if err := pa.NamePolicy.WillingToIssue(domain); err != nil {
+			return err
+		}
+	}
+
+	// Enforce the issuing chain's Name Constraints, independent of the
+	// policies above, so a technically-constrained sub-CA can't be coerced
+	// into over-issuing by a bug further up the policy stack.
+	if pa.constraints != nil {
+		if err := pa.constraints.CheckDNS(domain); err != nil {
+			return &NamePolicyError{Reason: NotAllowed, Detail: err.Error(), Identifier: id.Value}
+		}
 	}
 
 	return nil
 }
 
+// willingToIssueIP determines whether the CA is willing to issue for an
+// IP-address identifier: the value must parse as an IP, must not fall in
+// a reserved/private/loopback/link-local range unless the CA allows
+// internal addresses, and must not match an operator-configured deny
+// range.
+func (pa PolicyAuthorityImpl) willingToIssueIP(id core.AcmeIdentifier) error {
+	ip := net.ParseIP(id.Value)
+	if ip == nil {
+		return &NamePolicyError{Reason: CannotParseIP, Identifier: id.Value}
+	}
+
+	if !pa.AllowInternalAddresses {
+		for _, reserved := range reservedIPRanges {
+			if reserved.Contains(ip) {
+				return &NamePolicyError{Reason: NotAllowed, Detail: "reserved/private IP range", Identifier: id.Value}
+			}
+		}
+	}
+
+	for _, denied := range pa.DeniedIPRanges {
+		if denied.Contains(ip) {
+			return &NamePolicyError{Reason: Blocked, Identifier: id.Value}
+		}
+	}
+
+	if pa.NamePolicy != nil {
+		if err := pa.NamePolicy.WillingToIssueIP(id.Value); err != nil {
+			return err
+		}
+	}
+
+	if pa.constraints != nil {
+		if err := pa.constraints.CheckIP(ip); err != nil {
+			return &NamePolicyError{Reason: NotAllowed, Detail: err.Error(), Identifier: id.Value}
+		}
+	}
+
+	return nil
+}
+
+// WillingToIssueForAccount is like WillingToIssue, but additionally
+// layers any per-registration overlay policy configured for regID on top
+// of the global policy: an identifier must pass the global allow/deny
+// AND the per-account allow/deny before issuance is permitted.
+func (pa PolicyAuthorityImpl) WillingToIssueForAccount(id core.AcmeIdentifier, regID int64) error {
+	if err := pa.WillingToIssue(id); err != nil {
+		return err
+	}
+	if pa.NamePolicy == nil {
+		return nil
+	}
+	if id.Type == core.IdentifierIP {
+		return pa.NamePolicy.WillingToIssueIPForAccount(id.Value, regID)
+	}
+	return pa.NamePolicy.WillingToIssueForAccount(strings.ToLower(id.Value), regID)
+}
+
 // ChallengesFor makes a decision of what challenges, and combinations, are
 // acceptable for the given identifier.
 //
 // Note: Current implementation is static, but future versions may not be.
 func (pa PolicyAuthorityImpl) ChallengesFor(identifier core.AcmeIdentifier) (challenges []core.Challenge, combinations [][]int) {
+	if identifier.Type == core.IdentifierIP {
+		// IP identifiers can't be validated with DNS-01 (there's no zone
+		// to put a TXT record in), so offer only the challenge types that
+		// can be satisfied by something listening on the IP itself.
+		challenges = []core.Challenge{
+			core.TLSALPNChallenge(),
+			core.IPHTTPChallenge(),
+		}
+		combinations = [][]int{
+			[]int{0},
+			[]int{1},
+		}
+		return
+	}
+
 	challenges = []core.Challenge{
 		core.SimpleHTTPChallenge(),
 		core.DvsniChallenge(),
@@ -0,0 +1,68 @@
+// Copyright 2016 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package policy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/letsencrypt/boulder/core"
+	"github.com/letsencrypt/boulder/test"
+)
+
+func ipIdentifier(value string) core.AcmeIdentifier {
+	return core.AcmeIdentifier{Type: core.IdentifierIP, Value: value}
+}
+
+func TestWillingToIssueRejectsReservedIPByDefault(t *testing.T) {
+	pa := PolicyAuthorityImpl{}
+	test.AssertError(t, pa.WillingToIssue(ipIdentifier("10.0.0.1")), "RFC 1918 private address should be rejected by default")
+	test.AssertError(t, pa.WillingToIssue(ipIdentifier("127.0.0.1")), "loopback address should be rejected by default")
+}
+
+func TestWillingToIssueAllowsReservedIPWhenConfigured(t *testing.T) {
+	pa := PolicyAuthorityImpl{AllowInternalAddresses: true}
+	test.AssertNotError(t, pa.WillingToIssue(ipIdentifier("10.0.0.1")), "reserved address should be permitted when AllowInternalAddresses is set")
+}
+
+func TestWillingToIssueDeniedIPRangeWins(t *testing.T) {
+	_, denied, err := net.ParseCIDR("203.0.113.0/24")
+	test.AssertNotError(t, err, "failed to parse test CIDR")
+	pa := PolicyAuthorityImpl{DeniedIPRanges: []*net.IPNet{denied}}
+
+	test.AssertError(t, pa.WillingToIssue(ipIdentifier("203.0.113.5")), "operator-configured denied IP range should be rejected")
+	test.AssertNotError(t, pa.WillingToIssue(ipIdentifier("198.51.100.5")), "public IP outside any denied range should be permitted")
+}
+
+func TestWillingToIssueIPSyntaxError(t *testing.T) {
+	pa := PolicyAuthorityImpl{}
+	test.AssertError(t, pa.WillingToIssue(ipIdentifier("not-an-ip")), "value that doesn't parse as an IP should be rejected")
+}
+
+func TestWillingToIssueForAccountConsultsIPOverlay(t *testing.T) {
+	np, err := NewNamePolicyFromConfig(NamePolicyConfig{
+		PerAccount: map[string]RuleSet{
+			"1001": {DeniedIPRanges: []string{"198.51.100.0/24"}},
+		},
+	})
+	test.AssertNotError(t, err, "config should compile")
+
+	pa := PolicyAuthorityImpl{NamePolicy: np}
+	test.AssertError(t, pa.WillingToIssueForAccount(ipIdentifier("198.51.100.5"), 1001), "per-account IP overlay should reject this account")
+	test.AssertNotError(t, pa.WillingToIssueForAccount(ipIdentifier("198.51.100.5"), 2002), "per-account IP overlay must not apply to another account")
+}
+
+func TestChallengesForIPIdentifier(t *testing.T) {
+	pa := PolicyAuthorityImpl{}
+	challenges, combinations := pa.ChallengesFor(ipIdentifier("203.0.113.5"))
+
+	test.AssertEquals(t, len(challenges), 2)
+	test.AssertEquals(t, len(combinations), 2)
+	for _, c := range challenges {
+		test.Assert(t, c.Type == core.ChallengeTypeTLSALPN01 || c.Type == core.ChallengeTypeIPHTTP01,
+			"IP identifiers must only offer challenges satisfiable by something listening on the IP itself")
+	}
+}
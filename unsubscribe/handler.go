@@ -0,0 +1,50 @@
+// Copyright 2015 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package unsubscribe
+
+import (
+	"net/http"
+	"time"
+)
+
+// RegistrationUpdater is the slice of sa.SA the unsubscribe handler
+// needs: enough to flip NoExpirationMail without pulling in the rest of
+// the storage authority interface.
+type RegistrationUpdater interface {
+	SetNoExpirationMail(regID int64) error
+}
+
+// MaxTokenAge bounds how long an unsubscribe link embedded in a sent
+// email remains valid.
+const MaxTokenAge = 90 * 24 * time.Hour
+
+// Handler returns an http.HandlerFunc suitable for mounting at the WFE's
+// "/unsubscribe" route. It verifies the token query parameter and, if
+// valid, sets the NoExpirationMail flag on the corresponding
+// registration so the mailer stops nagging it.
+func Handler(updater RegistrationUpdater, secret []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			http.Error(w, "missing token", http.StatusBadRequest)
+			return
+		}
+
+		regID, err := VerifyToken(secret, token, MaxTokenAge)
+		if err != nil {
+			http.Error(w, "invalid or expired token", http.StatusBadRequest)
+			return
+		}
+
+		if err := updater.SetNoExpirationMail(regID); err != nil {
+			http.Error(w, "couldn't update registration", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("You have been unsubscribed from expiration notices."))
+	}
+}
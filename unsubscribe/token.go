@@ -0,0 +1,76 @@
+// Copyright 2015 ISRG.  All rights reserved
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package unsubscribe implements signed tokens that let the expiration
+// mailer embed a one-click unsubscribe link (as a List-Unsubscribe
+// header and in the mail body) without requiring the recipient to
+// authenticate with their ACME account key.
+package unsubscribe
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GenerateToken produces a signed, URL-safe token binding regID to the
+// instant it was issued. The token is an HMAC over "regID|timestamp",
+// so it can be verified without any server-side state.
+func GenerateToken(secret []byte, regID int64, now time.Time) string {
+	payload := fmt.Sprintf("%d|%d", regID, now.Unix())
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	sig := mac.Sum(nil)
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// VerifyToken checks token's signature and returns the registration ID it
+// was issued for. maxAge bounds how old a token may be before it's
+// rejected; pass 0 to accept tokens of any age.
+func VerifyToken(secret []byte, token string, maxAge time.Duration) (int64, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("unsubscribe: malformed token")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return 0, fmt.Errorf("unsubscribe: malformed token payload")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return 0, fmt.Errorf("unsubscribe: malformed token signature")
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	expectedSig := mac.Sum(nil)
+	if !hmac.Equal(sig, expectedSig) {
+		return 0, fmt.Errorf("unsubscribe: invalid token signature")
+	}
+
+	fields := strings.SplitN(string(payload), "|", 2)
+	if len(fields) != 2 {
+		return 0, fmt.Errorf("unsubscribe: malformed token payload")
+	}
+	regID, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unsubscribe: malformed registration ID in token")
+	}
+	issuedAt, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unsubscribe: malformed timestamp in token")
+	}
+
+	if maxAge > 0 && time.Since(time.Unix(issuedAt, 0)) > maxAge {
+		return 0, fmt.Errorf("unsubscribe: token expired")
+	}
+
+	return regID, nil
+}